@@ -0,0 +1,109 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func isBlockCommand(name string) bool {
+	return name == "block" || name == "unblock" || name == "blocklist"
+}
+
+// blockCommand implements the "alpaca block", "alpaca unblock" and "alpaca blocklist"
+// subcommands, which change or list the proxies blocked by a running instance of Alpaca. It
+// returns the exit status for the process.
+func blockCommand(name string, args []string, stdout, stderr io.Writer) int {
+	usage := "usage: alpaca " + name + " [flags]"
+	if name != "blocklist" {
+		usage += " host:port"
+	}
+	fs := flag.NewFlagSet("alpaca "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, usage)
+		fs.PrintDefaults()
+	}
+	host := fs.String("l", "localhost", "address that alpaca is listening on")
+	port := fs.Int("p", 3128, "port number that alpaca is listening on")
+	var duration *time.Duration
+	if name == "block" {
+		duration = fs.Duration("d", 0, "how long to block the proxy for (default: until unblocked)")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	query := url.Values{}
+	method := http.MethodGet
+	if name != "blocklist" {
+		if fs.NArg() != 1 {
+			fmt.Fprintln(stderr, usage)
+			return 2
+		} else if _, _, err := net.SplitHostPort(fs.Arg(0)); err != nil {
+			fmt.Fprintf(stderr, "Invalid proxy %q: expected host:port\n", fs.Arg(0))
+			return 2
+		}
+		query.Set("proxy", fs.Arg(0))
+		method = http.MethodDelete
+	} else if fs.NArg() != 0 {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	if name == "block" {
+		method = http.MethodPost
+		if *duration > 0 {
+			query.Set("duration", duration.String())
+		}
+	}
+
+	u := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(*host, strconv.Itoa(*port)),
+		Path:     "/blocklist",
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error creating request: %v\n", err)
+		return 1
+	}
+	// Talk to Alpaca directly, even if http_proxy is set (e.g. to Alpaca itself).
+	client := http.Client{Transport: &http.Transport{Proxy: nil}, Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error connecting to alpaca: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading response from alpaca: %v\n", err)
+		return 1
+	} else if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "Error from alpaca: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	_, _ = stdout.Write(body)
+	return 0
+}
@@ -0,0 +1,65 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCommand(t *testing.T) {
+	pf := NewProxyFinder(newPACFetcher("http://pacserver.invalid/nonexistent.pac"), nil,
+		NewPACWrapper(PACData{Port: 1}), new(PACRunner))
+	mux := http.NewServeMux()
+	pf.SetupHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	run := func(name string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-l", host, "-p", port}, args...)
+		status := blockCommand(name, args, &stdout, &stderr)
+		return status, stdout.String(), stderr.String()
+	}
+
+	status, stdout, stderr := run("block", "-d", "1h", "proxy.test:8080")
+	require.Equal(t, 0, status, stderr)
+	assert.Equal(t, "proxy.test:8080 blocked by hand for 1h0m0s\n", stdout)
+	assert.True(t, pf.blocked.contains("proxy.test:8080"))
+
+	status, stdout, stderr = run("blocklist")
+	require.Equal(t, 0, status, stderr)
+	assert.Equal(t, "proxy.test:8080 blocked by hand for 1h0m0s\n", stdout)
+
+	status, stdout, stderr = run("unblock", "proxy.test:8080")
+	require.Equal(t, 0, status, stderr)
+	assert.Equal(t, "", stdout)
+	assert.False(t, pf.blocked.contains("proxy.test:8080"))
+
+	status, _, stderr = run("unblock", "proxy.test:8080")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "proxy isn't blocked: proxy.test:8080")
+
+	status, _, stderr = run("block", "proxy.test")
+	assert.Equal(t, 2, status)
+	assert.Contains(t, stderr, `Invalid proxy "proxy.test": expected host:port`)
+}
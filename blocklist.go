@@ -16,6 +16,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -24,58 +26,163 @@ import (
 // https://crsrc.org/net/docs/proxy.md).
 const maxAge = 5 * time.Minute
 
+// blockPolicy controls when, and for how long, a failing proxy is blocked.
+type blockPolicy struct {
+	// How long to block a proxy for the first time. Each time a proxy is blocked again
+	// (without recovering in between), this is doubled, up to maxTime.
+	initialTime time.Duration
+	maxTime     time.Duration
+	// The number of consecutive failures before a proxy is blocked.
+	threshold int
+}
+
+var defaultBlockPolicy = blockPolicy{initialTime: maxAge, maxTime: time.Hour, threshold: 1}
+
 type blocklist struct {
-	entries []string             // Slice of entries, ordered by expiry time
-	expiry  map[string]time.Time // Map containing the expiry time for each entry
+	policy  blockPolicy
+	entries map[string]*blockEntry
 	now     func() time.Time
 	mux     sync.Mutex
 }
 
+type blockEntry struct {
+	failures    int           // Consecutive failures since the proxy last worked
+	lastFailure time.Time     // Time of the most recent failure
+	duration    time.Duration // How long the proxy was blocked for the last time
+	expiry      time.Time     // The time that the current block ends, or zero if not blocked
+	manual      bool          // Blocked by hand (see block), rather than due to failures
+}
+
 func newBlocklist() *blocklist {
 	return &blocklist{
-		entries: []string{},
-		expiry:  map[string]time.Time{},
+		policy:  defaultBlockPolicy,
+		entries: map[string]*blockEntry{},
 		now:     time.Now,
 	}
 }
 
+func (b *blocklist) setPolicy(policy blockPolicy) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.policy = policy
+}
+
+// add records a failure to connect to a proxy, and blocks the proxy if it has failed too many
+// times in a row. Proxies that are blocked by hand are left alone.
 func (b *blocklist) add(entry string) {
 	b.mux.Lock()
 	defer b.mux.Unlock()
-	b.sweep()
-	if _, ok := b.expiry[entry]; ok {
-		// Ignore duplicate entries. An entry can only have a single expiry time, so it
-		// shouldn't be added to the `entries` slice twice. Otherwise we'll have problems
-		// deleting it later.
+	now := b.now()
+	e, ok := b.entries[entry]
+	if ok && e.manual {
+		if e.expiry.IsZero() || now.Before(e.expiry) {
+			return
+		}
+		// The block by hand has ended, so start counting failures afresh.
+		ok = false
+	}
+	if !ok || now.Sub(e.lastFailure) > b.policy.maxTime {
+		// Forget about failures from long ago.
+		e = &blockEntry{}
+		b.entries[entry] = e
+	} else if now.Before(e.expiry) {
+		// Ignore failures while the proxy is blocked (e.g. from requests that were
+		// already in progress), so that they don't extend the block.
+		return
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < b.policy.threshold {
 		return
 	}
-	b.expiry[entry] = b.now().Add(maxAge)
-	b.entries = append(b.entries, entry)
+	if e.duration == 0 {
+		e.duration = b.policy.initialTime
+	} else {
+		e.duration = min(2*e.duration, b.policy.maxTime)
+	}
+	e.expiry = now.Add(e.duration)
 }
 
-func (b *blocklist) contains(entry string) bool {
+// remove records that a proxy is working, which unblocks it (unless it was blocked by hand)
+// and resets its backoff.
+func (b *blocklist) remove(entry string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if e, ok := b.entries[entry]; ok && !e.manual {
+		delete(b.entries, entry)
+	}
+}
+
+// block blocks a proxy by hand, for the given duration (or until it's unblocked by hand, if
+// the duration is zero). This isn't affected by health checks or PAC updates.
+func (b *blocklist) block(entry string, d time.Duration) {
 	b.mux.Lock()
 	defer b.mux.Unlock()
-	b.sweep()
-	_, ok := b.expiry[entry]
+	e := &blockEntry{manual: true}
+	if d > 0 {
+		e.expiry = b.now().Add(d)
+	}
+	b.entries[entry] = e
+}
+
+// unblock unblocks a proxy by hand, and forgets about any failures.
+func (b *blocklist) unblock(entry string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	_, ok := b.entries[entry]
+	delete(b.entries, entry)
 	return ok
 }
 
-func (b *blocklist) sweep() {
-	// Delete any stale entries from both the slice and the map. This function is *not*
-	// reentrant; `mux` should be locked before calling this function!
-	count := 0
-	for _, entry := range b.entries {
-		expiry, ok := b.expiry[entry]
-		if !ok {
-			// This should never happen.
-			panic(fmt.Sprintf("blocklist contains entry %q without expiry time", entry))
+func (b *blocklist) contains(entry string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	e, ok := b.entries[entry]
+	if !ok {
+		return false
+	} else if e.manual && e.expiry.IsZero() {
+		return true
+	} else if e.manual && !b.now().Before(e.expiry) {
+		delete(b.entries, entry)
+		return false
+	}
+	return b.now().Before(e.expiry)
+}
+
+// retain forgets about all proxies that aren't in the given set (except for those that were
+// blocked by hand). This is called when a new PAC script is loaded, so that proxies that are
+// still in use stay blocked.
+func (b *blocklist) retain(keep func(string) bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for entry, e := range b.entries {
+		if !e.manual && !keep(entry) {
+			delete(b.entries, entry)
 		}
-		if b.now().Before(expiry) {
-			break
+	}
+}
+
+// String describes the proxies that are currently blocked, one per line.
+func (b *blocklist) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := b.now()
+	var lines []string
+	for entry, e := range b.entries {
+		switch {
+		case e.manual && e.expiry.IsZero():
+			lines = append(lines, fmt.Sprintf("%s blocked by hand", entry))
+		case e.manual && now.Before(e.expiry):
+			lines = append(lines, fmt.Sprintf("%s blocked by hand for %v",
+				entry, e.expiry.Sub(now).Round(time.Second)))
+		case now.Before(e.expiry):
+			lines = append(lines, fmt.Sprintf("%s blocked for %v after %d failures",
+				entry, e.expiry.Sub(now).Round(time.Second), e.failures))
 		}
-		delete(b.expiry, entry)
-		count++
 	}
-	b.entries = b.entries[count:]
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
 }
@@ -56,3 +56,100 @@ func TestBlocklistDuplicateEntry(t *testing.T) {
 	now = now.Add(3*time.Minute)
 	b.contains("foo")
 }
+
+func TestBlocklistRemove(t *testing.T) {
+	b := newBlocklist()
+	b.add("foo")
+	b.add("bar")
+	b.remove("foo")
+	b.remove("baz")
+	assert.False(t, b.contains("foo"))
+	assert.True(t, b.contains("bar"))
+	b.add("foo")
+	assert.True(t, b.contains("foo"))
+}
+
+func TestBlocklistBackoff(t *testing.T) {
+	b := newBlocklist()
+	b.setPolicy(blockPolicy{initialTime: time.Minute, maxTime: 3 * time.Minute, threshold: 1})
+	var now time.Time
+	b.now = func() time.Time { return now }
+	// Each time the proxy fails again after being unblocked, it's blocked for twice as long,
+	// up to the maximum.
+	for _, d := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		b.add("foo")
+		now = now.Add(d - time.Second)
+		assert.True(t, b.contains("foo"))
+		now = now.Add(time.Second)
+		assert.False(t, b.contains("foo"))
+	}
+	// Once it works again, the backoff starts from the beginning.
+	b.remove("foo")
+	b.add("foo")
+	now = now.Add(time.Minute)
+	assert.False(t, b.contains("foo"))
+	// The same happens if it hasn't failed for a long time.
+	now = now.Add(time.Hour)
+	b.add("foo")
+	now = now.Add(time.Minute)
+	assert.False(t, b.contains("foo"))
+}
+
+func TestBlocklistThreshold(t *testing.T) {
+	b := newBlocklist()
+	b.setPolicy(blockPolicy{initialTime: time.Minute, maxTime: time.Hour, threshold: 3})
+	b.add("foo")
+	b.add("foo")
+	assert.False(t, b.contains("foo"))
+	b.add("foo")
+	assert.True(t, b.contains("foo"))
+	b.remove("foo")
+	b.add("foo")
+	assert.False(t, b.contains("foo"))
+}
+
+func TestBlocklistManual(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	b.block("foo", 0)
+	b.block("bar", time.Minute)
+	// Health checks and PAC updates don't unblock proxies that were blocked by hand.
+	b.remove("foo")
+	b.retain(func(string) bool { return false })
+	now = now.Add(time.Hour)
+	assert.True(t, b.contains("foo"))
+	assert.False(t, b.contains("bar"))
+	assert.Equal(t, "foo blocked by hand\n", b.String())
+	assert.True(t, b.unblock("foo"))
+	assert.False(t, b.unblock("foo"))
+	assert.False(t, b.contains("foo"))
+	assert.Equal(t, "", b.String())
+}
+
+func TestBlocklistManualIgnoresFailures(t *testing.T) {
+	b := newBlocklist()
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	b.block("foo", 0)
+	b.block("bar", time.Minute)
+	// A failure followed by a successful health check doesn't replace the block by hand.
+	b.add("foo")
+	b.remove("foo")
+	assert.True(t, b.contains("foo"))
+	assert.Equal(t, "bar blocked by hand for 1m0s\nfoo blocked by hand\n", b.String())
+	// Once a block by hand ends, failures count as usual.
+	now = now.Add(2 * time.Minute)
+	b.add("bar")
+	assert.True(t, b.contains("bar"))
+	assert.Contains(t, b.String(), "bar blocked for 5m0s after 1 failures")
+}
+
+func TestBlocklistRetain(t *testing.T) {
+	b := newBlocklist()
+	b.add("foo")
+	b.add("bar")
+	b.retain(func(entry string) bool { return entry == "foo" })
+	assert.True(t, b.contains("foo"))
+	assert.False(t, b.contains("bar"))
+}
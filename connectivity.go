@@ -0,0 +1,202 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The ways of deciding whether we're online (i.e. whether to use the proxies from the PAC
+// script) or offline (i.e. whether to make requests directly).
+const (
+	// Online if the PAC script could be downloaded. This is the default.
+	connectivityPAC = "pac"
+	// Online if one of the proxies that the PAC script returns accepts TCP connections.
+	connectivityTCP = "tcp"
+	// Online if a URL can be fetched via one of the proxies that the PAC script returns.
+	connectivityURL = "url"
+)
+
+// connectivityChecker decides whether we're online or offline. In the tcp and url modes, it
+// checks the proxies that the PAC script returns for a probe URL, periodically and whenever
+// the network or PAC script changes. Every transition between online and offline is logged.
+type connectivityChecker struct {
+	mode     string
+	probeURL url.URL
+	interval time.Duration
+	timeout  time.Duration
+	runner   *PACRunner
+	dial     func(network, addr string, timeout time.Duration) (net.Conn, error)
+	get      func(proxy *url.URL, rawurl string, timeout time.Duration) error
+	// Used by getViaProxy. Keep-alives are disabled, since probes are infrequent and each
+	// one may go to a different proxy.
+	transport *http.Transport
+	online    atomic.Bool
+	known     bool // Whether we've decided yet
+	wake      chan struct{}
+	mux       sync.Mutex
+}
+
+// newConnectivityChecker returns a connectivityChecker for the given mode. If tls is nil, the
+// system's default TLS config is used to probe HTTPS proxies.
+func newConnectivityChecker(mode string, probeURL url.URL, interval time.Duration, runner *PACRunner, tls *proxyTLS) (*connectivityChecker, error) {
+	switch mode {
+	case connectivityPAC, connectivityTCP, connectivityURL:
+	default:
+		return nil, fmt.Errorf("unknown connectivity check %q (must be %s, %s or %s)",
+			mode, connectivityPAC, connectivityTCP, connectivityURL)
+	}
+	c := &connectivityChecker{
+		mode:      mode,
+		probeURL:  probeURL,
+		interval:  interval,
+		timeout:   5 * time.Second,
+		runner:    runner,
+		dial:      net.DialTimeout,
+		transport: &http.Transport{Proxy: getProxyFromContext, DisableKeepAlives: true},
+		wake:      make(chan struct{}, 1),
+	}
+	if tls != nil {
+		c.transport.DialTLSContext = tls.dialTLSContext
+	}
+	c.get = c.getViaProxy
+	return c, nil
+}
+
+// getViaProxy fetches a URL via the given proxy. Any response from the proxy (even an error,
+// such as 407 Proxy Authentication Required) means that the proxy is working.
+func (c *connectivityChecker) getViaProxy(proxy *url.URL, rawurl string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, contextKeyProxy, proxy)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// start checks connectivity in the background, if the mode requires it.
+func (c *connectivityChecker) start() {
+	if c.mode == connectivityPAC {
+		return
+	}
+	c.check()
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.wake:
+			}
+			c.check()
+		}
+	}()
+}
+
+// changed asks for connectivity to be checked again soon, e.g. because the network or the PAC
+// script has changed.
+func (c *connectivityChecker) changed() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pacDownloaded is called after every attempt to download the PAC script. This decides
+// whether we're online in the pac mode.
+func (c *connectivityChecker) pacDownloaded(connected bool) {
+	if c.mode != connectivityPAC {
+		return
+	} else if connected {
+		c.set(true, "downloaded the PAC script")
+	} else {
+		c.set(false, "couldn't download the PAC script")
+	}
+}
+
+func (c *connectivityChecker) check() {
+	online, reason := c.probe()
+	c.set(online, reason)
+}
+
+func (c *connectivityChecker) probe() (bool, string) {
+	if !c.runner.loaded() {
+		return false, "no PAC script has been loaded"
+	}
+	result, err := c.runner.FindProxyForURL(c.probeURL)
+	if err != nil {
+		return false, fmt.Sprintf("error running PAC script: %v", err)
+	}
+	entries, _ := parseProxyList(result)
+	var failures []string
+	for _, entry := range entries {
+		if entry.proxy == nil {
+			continue
+		}
+		if c.mode == connectivityTCP {
+			var conn net.Conn
+			if conn, err = c.dial("tcp", entry.proxy.Host, c.timeout); err == nil {
+				conn.Close()
+			}
+		} else {
+			err = c.get(entry.proxy, c.probeURL.String(), c.timeout)
+		}
+		if err == nil {
+			return true, fmt.Sprintf("proxy %s is reachable", entry.proxy.Host)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", entry.proxy.Host, err))
+	}
+	if len(failures) == 0 {
+		// There aren't any proxies to check, but the PAC script works.
+		return true, fmt.Sprintf("PAC script returned %q for %s", result, c.probeURL.String())
+	}
+	return false, "no proxies are reachable (" + strings.Join(failures, "; ") + ")"
+}
+
+func (c *connectivityChecker) set(online bool, reason string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.known && c.online.Load() == online {
+		return
+	}
+	c.known = true
+	c.online.Store(online)
+	if online {
+		log.Printf("Online (%s), using proxies from the PAC script", reason)
+	} else {
+		log.Printf("Offline (%s), making requests directly", reason)
+	}
+}
+
+func (c *connectivityChecker) isOnline() bool {
+	return c.online.Load()
+}
@@ -0,0 +1,163 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConnectivityChecker(t *testing.T, mode, pacjs string) *connectivityChecker {
+	var pr PACRunner
+	require.NoError(t, pr.Update([]byte(pacjs)))
+	probe := url.URL{Scheme: "http", Host: "www.test", Path: "/"}
+	c, err := newConnectivityChecker(mode, probe, time.Minute, &pr, nil)
+	require.NoError(t, err)
+	return c
+}
+
+func TestConnectivityTCP(t *testing.T) {
+	c := newTestConnectivityChecker(t, connectivityTCP, `function FindProxyForURL(url, host) {
+		return "PROXY down.test:80; PROXY up.test:80";
+	}`)
+	var dialled []string
+	reachable := map[string]bool{"up.test:80": true}
+	c.dial = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dialled = append(dialled, addr)
+		if !reachable[addr] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	c.check()
+	assert.True(t, c.isOnline())
+	assert.Equal(t, []string{"down.test:80", "up.test:80"}, dialled)
+	reachable["up.test:80"] = false
+	c.check()
+	assert.False(t, c.isOnline())
+}
+
+func TestConnectivityURL(t *testing.T) {
+	c := newTestConnectivityChecker(t, connectivityURL, `function FindProxyForURL(url, host) {
+		return "PROXY proxy.test:3128";
+	}`)
+	var fetched []string
+	var err error
+	c.get = func(proxy *url.URL, rawurl string, timeout time.Duration) error {
+		fetched = append(fetched, proxy.Host+" "+rawurl)
+		return err
+	}
+	c.check()
+	assert.True(t, c.isOnline())
+	assert.Equal(t, []string{"proxy.test:3128 http://www.test/"}, fetched)
+	err = errors.New("timeout")
+	c.check()
+	assert.False(t, c.isOnline())
+}
+
+func TestConnectivityURLClosesConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 64<<10))
+	}))
+	defer server.Close()
+	var mux sync.Mutex
+	open := 0
+	proxy := httptest.NewUnstartedServer(newDirectProxy())
+	proxy.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mux.Lock()
+		defer mux.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+	c := newTestConnectivityChecker(t, connectivityURL, `function FindProxyForURL(url, host) {
+		return "PROXY `+proxy.Listener.Addr().String()+`";
+	}`)
+	probe, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	c.probeURL = *probe
+	for i := 0; i < 3; i++ {
+		c.check()
+		assert.True(t, c.isOnline())
+	}
+	assert.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return open == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConnectivityWithoutProxies(t *testing.T) {
+	c := newTestConnectivityChecker(t, connectivityTCP, `function FindProxyForURL(url, host) {
+		return "DIRECT";
+	}`)
+	c.check()
+	assert.True(t, c.isOnline())
+	c.runner = new(PACRunner)
+	c.check()
+	assert.False(t, c.isOnline())
+}
+
+func TestConnectivityTransitionsAreLogged(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+	c, err := newConnectivityChecker(connectivityPAC, url.URL{}, 0, new(PACRunner), nil)
+	require.NoError(t, err)
+	c.pacDownloaded(true)
+	c.pacDownloaded(true)
+	c.pacDownloaded(false)
+	assert.True(t, bytes.Contains(logs.Bytes(), []byte("Online (downloaded the PAC script)")))
+	assert.True(t, bytes.Contains(logs.Bytes(), []byte("Offline (couldn't download the PAC script)")))
+	assert.Equal(t, 2, bytes.Count(logs.Bytes(), []byte("\n")))
+}
+
+func TestGetViaProxy(t *testing.T) {
+	// A proxy that requires authentication is still reachable.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	c, err := newConnectivityChecker(connectivityURL, url.URL{}, 0, new(PACRunner), nil)
+	require.NoError(t, err)
+	assert.NoError(t, c.getViaProxy(proxyURL, "http://www.test/", time.Second))
+	proxy.Close()
+	assert.Error(t, c.getViaProxy(proxyURL, "http://www.test/", time.Second))
+}
+
+func TestUnknownConnectivityCheck(t *testing.T) {
+	_, err := newConnectivityChecker("ping", url.URL{}, 0, new(PACRunner), nil)
+	assert.Error(t, err)
+}
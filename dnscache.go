@@ -0,0 +1,127 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Failed lookups are cached for a shorter time than successful ones, so that a transient
+// failure (or a timeout) doesn't stick around for too long.
+const maxNegativeTTL = 10 * time.Second
+
+// The maximum number of hosts to keep in the cache. This is only there to stop the cache from
+// growing without bound; a PAC script will normally only look up a small number of hosts.
+const maxDNSCacheEntries = 10000
+
+// dnsCache caches the results of the DNS lookups made by the PAC helper functions (dnsResolve,
+// isInNet, isResolvable, etc). Since a PAC script might look up the same host several times for
+// every request, and the lookups are made while evaluating the script, this stops a slow DNS
+// server from slowing down every request.
+type dnsCache struct {
+	ttl         time.Duration // How long to cache successful lookups for
+	negativeTTL time.Duration // How long to cache failed lookups for
+	timeout     time.Duration // How long to wait for a lookup before giving up (or 0 for no limit)
+	resolve     func(ctx context.Context, host string) ([]string, error)
+	now         func() time.Time
+	entries     map[string]*dnsCacheEntry
+	mux         sync.Mutex
+}
+
+type dnsCacheEntry struct {
+	addrs  []string
+	err    error
+	expiry time.Time
+	done   chan struct{} // Closed when the lookup has finished
+}
+
+func newDNSCache(ttl, timeout time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:         ttl,
+		negativeTTL: min(ttl, maxNegativeTTL),
+		timeout:     timeout,
+		resolve:     net.DefaultResolver.LookupHost,
+		now:         time.Now,
+		entries:     map[string]*dnsCacheEntry{},
+	}
+}
+
+// lookupHost has the same signature as net.LookupHost. If another goroutine is already looking
+// up the same host, this waits for (and returns) the result of that lookup.
+func (c *dnsCache) lookupHost(host string) ([]string, error) {
+	c.mux.Lock()
+	if entry, ok := c.entries[host]; ok {
+		select {
+		case <-entry.done:
+			if c.now().Before(entry.expiry) {
+				c.mux.Unlock()
+				return entry.addrs, entry.err
+			}
+		default:
+			c.mux.Unlock()
+			<-entry.done
+			return entry.addrs, entry.err
+		}
+	}
+	if len(c.entries) >= maxDNSCacheEntries {
+		c.sweep()
+	}
+	entry := &dnsCacheEntry{done: make(chan struct{})}
+	c.entries[host] = entry
+	c.mux.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+	defer cancel()
+	entry.addrs, entry.err = c.resolve(ctx, host)
+	if entry.err != nil {
+		entry.expiry = c.now().Add(c.negativeTTL)
+	} else {
+		entry.expiry = c.now().Add(c.ttl)
+	}
+	close(entry.done)
+	return entry.addrs, entry.err
+}
+
+// sweep deletes expired entries, or all entries if none have expired. The mutex must be held
+// when calling this function.
+func (c *dnsCache) sweep() {
+	now := c.now()
+	for host, entry := range c.entries {
+		select {
+		case <-entry.done:
+			if !now.Before(entry.expiry) {
+				delete(c.entries, host)
+			}
+		default:
+		}
+	}
+	if len(c.entries) >= maxDNSCacheEntries {
+		c.entries = map[string]*dnsCacheEntry{}
+	}
+}
+
+// flush deletes all entries from the cache. This should be called when the network changes,
+// since hosts might resolve differently (e.g. on a VPN, or behind split-horizon DNS).
+func (c *dnsCache) flush() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries = map[string]*dnsCacheEntry{}
+}
@@ -0,0 +1,147 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	addrs map[string][]string
+	count map[string]int
+	mux   sync.Mutex
+}
+
+func (r *fakeResolver) resolve(ctx context.Context, host string) ([]string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.count[host]++
+	if addrs, ok := r.addrs[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func newTestDNSCache() (*dnsCache, *fakeResolver, *time.Time) {
+	r := &fakeResolver{
+		addrs: map[string][]string{"www.test": {"192.0.2.1"}},
+		count: map[string]int{},
+	}
+	var now time.Time
+	c := newDNSCache(time.Minute, time.Second)
+	c.resolve = r.resolve
+	c.now = func() time.Time { return now }
+	return c, r, &now
+}
+
+func TestDNSCache(t *testing.T) {
+	c, r, now := newTestDNSCache()
+	for i := 0; i < 3; i++ {
+		addrs, err := c.lookupHost("www.test")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1"}, addrs)
+	}
+	assert.Equal(t, 1, r.count["www.test"])
+	*now = now.Add(59 * time.Second)
+	_, err := c.lookupHost("www.test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.count["www.test"])
+	*now = now.Add(time.Second)
+	_, err = c.lookupHost("www.test")
+	require.NoError(t, err)
+	assert.Equal(t, 2, r.count["www.test"])
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	c, r, now := newTestDNSCache()
+	_, err := c.lookupHost("nonexistent.test")
+	assert.Error(t, err)
+	_, err = c.lookupHost("nonexistent.test")
+	assert.Error(t, err)
+	assert.Equal(t, 1, r.count["nonexistent.test"])
+	*now = now.Add(maxNegativeTTL)
+	_, err = c.lookupHost("nonexistent.test")
+	assert.Error(t, err)
+	assert.Equal(t, 2, r.count["nonexistent.test"])
+}
+
+func TestDNSCacheFlush(t *testing.T) {
+	c, r, _ := newTestDNSCache()
+	_, err := c.lookupHost("www.test")
+	require.NoError(t, err)
+	c.flush()
+	r.addrs["www.test"] = []string{"192.0.2.2"}
+	addrs, err := c.lookupHost("www.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2"}, addrs)
+	assert.Equal(t, 2, r.count["www.test"])
+}
+
+func TestDNSCacheTimeout(t *testing.T) {
+	c, _, _ := newTestDNSCache()
+	c.timeout = time.Millisecond
+	c.resolve = func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err := c.lookupHost("slow.test")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDNSCacheNoTimeout(t *testing.T) {
+	c, _, _ := newTestDNSCache()
+	c.timeout = 0
+	c.resolve = func(ctx context.Context, host string) ([]string, error) {
+		if _, ok := ctx.Deadline(); ok {
+			return nil, errors.New("unexpected deadline")
+		}
+		return []string{"192.0.2.1"}, ctx.Err()
+	}
+	addrs, err := c.lookupHost("www.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, addrs)
+}
+
+func TestDNSCacheConcurrentLookups(t *testing.T) {
+	c, _, _ := newTestDNSCache()
+	release := make(chan struct{})
+	var count int
+	c.resolve = func(ctx context.Context, host string) ([]string, error) {
+		count++
+		<-release
+		return []string{"192.0.2.1"}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := c.lookupHost("www.test")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"192.0.2.1"}, addrs)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, count)
+}
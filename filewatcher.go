@@ -0,0 +1,88 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often to check a file for changes, on platforms where it can't be watched using the
+// operating system's file notification API.
+var filePollInterval = 2 * time.Second
+
+// fileWatcher calls a function whenever a file is modified (or created, replaced or deleted).
+// On Linux, it uses inotify to watch the file's directory, which means that it also notices
+// when an editor saves the file by writing a new file and renaming it over the old one. On
+// other platforms (or if inotify isn't available), it polls the file's size and modification
+// time.
+type fileWatcher struct {
+	path     string
+	onChange func()
+	done     chan struct{}
+	closer   io.Closer // Used to stop the native watcher, if there is one
+	once     sync.Once
+}
+
+func newFileWatcher(path string, onChange func()) *fileWatcher {
+	w := &fileWatcher{path: path, onChange: onChange, done: make(chan struct{})}
+	if err := w.watchNative(); err != nil {
+		log.Printf("Can't watch %s for changes (%v), polling every %v instead",
+			path, err, filePollInterval)
+		w.startPolling()
+	}
+	return w
+}
+
+func (w *fileWatcher) startPolling() {
+	last, _ := os.Stat(w.path)
+	go w.poll(last)
+}
+
+func (w *fileWatcher) poll(last os.FileInfo) {
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		info, _ := os.Stat(w.path)
+		if !sameFileInfo(last, info) {
+			w.onChange()
+		}
+		last = info
+	}
+}
+
+func sameFileInfo(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+func (w *fileWatcher) close() {
+	w.once.Do(func() {
+		close(w.done)
+		if w.closer != nil {
+			w.closer.Close()
+		}
+	})
+}
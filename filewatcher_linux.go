@@ -0,0 +1,70 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func (w *fileWatcher) watchNative() error {
+	// Since the inotify file descriptor is non-blocking, os.File uses the runtime's poller,
+	// which means that closing the file will interrupt a pending Read.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(filepath.Clean(w.path))
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_MOVED_FROM)
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+	w.closer = f
+	go w.readEvents(f, name)
+	return nil
+}
+
+func (w *fileWatcher) readEvents(f *os.File, name string) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			// The watcher has been closed.
+			return
+		}
+		changed := false
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			end := start + int(event.Len)
+			if end > n {
+				break
+			}
+			if string(bytes.TrimRight(buf[start:end], "\x00")) == name {
+				changed = true
+			}
+			offset = end
+		}
+		if changed {
+			w.onChange()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForChange(t *testing.T, changed <-chan struct{}) {
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for file change")
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+	changed := make(chan struct{}, 10)
+	w := newFileWatcher(path, func() { changed <- struct{}{} })
+	defer w.close()
+	require.NoError(t, os.WriteFile(path, []byte("new"), 0644))
+	waitForChange(t, changed)
+	// Replacing the file (as many editors do when saving) also counts as a change.
+	tmp := filepath.Join(filepath.Dir(path), "proxy.pac.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("newer"), 0644))
+	require.NoError(t, os.Rename(tmp, path))
+	waitForChange(t, changed)
+}
+
+func TestFileWatcherPolling(t *testing.T) {
+	defer func(d time.Duration) { filePollInterval = d }(filePollInterval)
+	filePollInterval = 10 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+	changed := make(chan struct{}, 10)
+	w := &fileWatcher{path: path, onChange: func() { changed <- struct{}{} }, done: make(chan struct{})}
+	w.startPolling()
+	defer w.close()
+	require.NoError(t, os.WriteFile(path, []byte("newer"), 0644))
+	waitForChange(t, changed)
+	require.NoError(t, os.Remove(path))
+	waitForChange(t, changed)
+}
@@ -5,12 +5,14 @@ go 1.22.3
 toolchain go1.22.4
 
 require (
+	github.com/dop251/goja v0.0.0-20240516125602-ccbae20bcec2
 	github.com/gobwas/glob v0.2.3
 	github.com/keybase/go-keychain v0.0.0-20231219164618-57a3676c3af6
 	github.com/robertkrimen/otto v0.4.0
 	github.com/samuong/go-ntlmssp v0.0.0-20240616070040-65a20607c744
 	github.com/stretchr/testify v1.9.0
 	github.com/zalando/go-keyring v0.2.5
+	golang.org/x/sys v0.21.0
 	golang.org/x/term v0.21.0
 )
 
@@ -18,10 +20,12 @@ require (
 	github.com/alessio/shellescape v1.4.1 // indirect
 	github.com/danieljoos/wincred v1.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dlclark/regexp2 v1.7.0 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.24.0 // indirect
-	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
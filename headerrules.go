@@ -0,0 +1,243 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gobwas/glob"
+)
+
+// headerRules adds, sets and removes the headers of requests (and their responses) that are
+// forwarded by the ProxyHandler. The rules are read from a file, which looks like this:
+//
+//	# Send a token to the internal artifact server.
+//	match host=artifacts.example.com method=GET,HEAD
+//	  request set Authorization Bearer 0123456789
+//	  response remove Set-Cookie
+//	match path=/api/*
+//	  request add X-Debug true
+//
+// Each "match" line starts a new rule, and gives the host, path and methods that it applies to
+// (any that are left out match everything). Host and path patterns use the same syntax as
+// shExpMatch. The lines after it give the changes to make to matching requests or responses.
+// Every matching rule is applied, in order. The file is reloaded whenever it changes.
+type headerRules struct {
+	path    string
+	rules   atomic.Pointer[[]headerRule]
+	watcher *fileWatcher
+}
+
+type headerRule struct {
+	line    int       // Line number of the "match" line, for logging
+	pattern string    // The host pattern, as given ("" to match any host)
+	host    glob.Glob // nil to match any host
+	path    glob.Glob // nil to match any path
+	methods []string  // nil to match any method
+	actions []headerAction
+}
+
+type headerAction struct {
+	response bool   // Whether this applies to the response (rather than the request)
+	op       string // "add", "set" or "remove"
+	name     string
+	value    string
+}
+
+func newHeaderRules(path string) (*headerRules, error) {
+	hr := &headerRules{path: path}
+	if err := hr.load(); err != nil {
+		return nil, err
+	}
+	return hr, nil
+}
+
+func (hr *headerRules) load() error {
+	data, err := os.ReadFile(hr.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseHeaderRules(hr.path, data)
+	if err != nil {
+		return err
+	}
+	hr.rules.Store(&rules)
+	return nil
+}
+
+// watch reloads the rules whenever the file changes.
+func (hr *headerRules) watch() {
+	hr.watcher = newFileWatcher(hr.path, hr.reload)
+}
+
+func (hr *headerRules) reload() {
+	if err := hr.load(); err != nil {
+		log.Printf("Error reloading header rules, still using the previous rules: %v", err)
+		return
+	}
+	log.Printf("Reloaded header rules from %s", hr.path)
+}
+
+func parseHeaderRules(name string, data []byte) ([]headerRule, error) {
+	var rules []headerRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "match" {
+			rule, err := parseMatch(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+			rule.line = n
+			rules = append(rules, rule)
+			continue
+		} else if len(rules) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected a match line before %q", name, n, fields[0])
+		}
+		action, err := parseAction(line, fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		last := &rules[len(rules)-1]
+		last.actions = append(last.actions, action)
+	}
+	return rules, scanner.Err()
+}
+
+func parseMatch(conditions []string) (headerRule, error) {
+	var rule headerRule
+	for _, condition := range conditions {
+		key, value, ok := strings.Cut(condition, "=")
+		if !ok || value == "" {
+			return rule, fmt.Errorf("invalid condition %q: expected key=value", condition)
+		}
+		var err error
+		switch key {
+		case "host":
+			rule.pattern = strings.ToLower(value)
+			rule.host, err = glob.Compile(rule.pattern)
+		case "path":
+			rule.path, err = glob.Compile(value)
+		case "method":
+			rule.methods = strings.Split(strings.ToUpper(value), ",")
+		default:
+			return rule, fmt.Errorf("unknown condition %q (must be host, path or method)", key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid pattern for %s: %w", key, err)
+		}
+	}
+	return rule, nil
+}
+
+func parseAction(line string, fields []string) (headerAction, error) {
+	var action headerAction
+	if len(fields) < 3 {
+		return action, fmt.Errorf("expected request|response add|set|remove <header> [value]")
+	}
+	switch fields[0] {
+	case "request":
+	case "response":
+		action.response = true
+	default:
+		return action, fmt.Errorf("expected request or response, got %q", fields[0])
+	}
+	action.op = fields[1]
+	action.name = http.CanonicalHeaderKey(fields[2])
+	switch action.op {
+	case "add", "set":
+		// The value is the rest of the line (which may contain spaces).
+		rest := strings.TrimSpace(line)
+		for _, field := range fields[:3] {
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, field))
+		}
+		action.value = rest
+	case "remove":
+		if len(fields) > 3 {
+			return action, fmt.Errorf("unexpected value for remove: %q", strings.Join(fields[3:], " "))
+		}
+	default:
+		return action, fmt.Errorf("unknown action %q (must be add, set or remove)", action.op)
+	}
+	return action, nil
+}
+
+// hosts returns the host patterns that the rules apply to. A rule that applies to every host
+// is given as "*".
+func (hr *headerRules) hosts() []string {
+	var hosts []string
+	for _, rule := range *hr.rules.Load() {
+		if rule.pattern == "" {
+			return []string{"*"}
+		}
+		hosts = append(hosts, rule.pattern)
+	}
+	return hosts
+}
+
+func (rule *headerRule) matches(req *http.Request) bool {
+	if rule.host != nil && !rule.host.Match(strings.ToLower(req.URL.Hostname())) {
+		return false
+	} else if rule.path != nil && !rule.path.Match(req.URL.Path) {
+		return false
+	} else if rule.methods == nil {
+		return true
+	}
+	for _, method := range rule.methods {
+		if method == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// apply makes the changes that the matching rules make to the request's headers, or (if
+// response is true) to the response's headers.
+func (hr *headerRules) apply(req *http.Request, header http.Header, response bool) {
+	if hr == nil {
+		return
+	}
+	id := req.Context().Value(contextKeyID)
+	for _, rule := range *hr.rules.Load() {
+		if !rule.matches(req) {
+			continue
+		}
+		for _, action := range rule.actions {
+			if action.response != response {
+				continue
+			}
+			log.Printf("[%d] Header rule on line %d: %s %s", id, rule.line, action.op, action.name)
+			switch action.op {
+			case "add":
+				header.Add(action.name, action.value)
+			case "set":
+				header.Set(action.name, action.value)
+			case "remove":
+				header.Del(action.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHeaderRules = `# Comments and blank lines are ignored.
+
+match host=*.artifacts.test method=GET,HEAD
+  request set Authorization Bearer  token with spaces
+  response remove set-cookie
+match path=/api/*
+  request add X-Debug one
+  request add X-Debug two
+  request remove User-Agent
+  response set X-Rewritten true
+`
+
+func writeHeaderRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0644))
+	return path
+}
+
+func TestParseHeaderRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"NoMatch", "request set X-A b", "rules:1: expected a match line before \"request\""},
+		{"BadCondition", "match host", "rules:1: invalid condition \"host\": expected key=value"},
+		{"UnknownCondition", "match port=80", "rules:1: unknown condition \"port\""},
+		{"BadPattern", "match host=[oops", "rules:1: invalid pattern for host"},
+		{"BadDirection", "match\nreply set X-A b", "rules:2: expected request or response"},
+		{"BadOp", "match\nrequest append X-A b", "rules:2: unknown action \"append\""},
+		{"TooShort", "match\nrequest set", "rules:2: expected request|response"},
+		{"RemoveValue", "match\nrequest remove X-A b", "rules:2: unexpected value for remove"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseHeaderRules("rules", []byte(test.rules))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.err)
+		})
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	hr, err := newHeaderRules(writeHeaderRules(t, testHeaderRules))
+	require.NoError(t, err)
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		request  http.Header
+		response http.Header
+	}{
+		{"NoMatch", http.MethodGet, "http://www.test/",
+			http.Header{"User-Agent": {"test"}},
+			http.Header{"Set-Cookie": {"a=b"}}},
+		{"Host", http.MethodGet, "http://www.Artifacts.test/",
+			http.Header{"User-Agent": {"test"}, "Authorization": {"Bearer  token with spaces"}},
+			http.Header{}},
+		{"Method", http.MethodPost, "http://www.artifacts.test/",
+			http.Header{"User-Agent": {"test"}},
+			http.Header{"Set-Cookie": {"a=b"}}},
+		{"Path", http.MethodPost, "http://www.test/api/v1",
+			http.Header{"X-Debug": {"one", "two"}},
+			http.Header{"Set-Cookie": {"a=b"}, "X-Rewritten": {"true"}}},
+		{"Both", http.MethodGet, "https://www.artifacts.test/api/v1",
+			http.Header{"Authorization": {"Bearer  token with spaces"}, "X-Debug": {"one", "two"}},
+			http.Header{"X-Rewritten": {"true"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.url, nil)
+			req.Header.Set("User-Agent", "test")
+			hr.apply(req, req.Header, false)
+			assert.Equal(t, test.request, req.Header)
+			response := http.Header{"Set-Cookie": {"a=b"}}
+			hr.apply(req, response, true)
+			assert.Equal(t, test.response, response)
+		})
+	}
+}
+
+func TestHeaderRulesReload(t *testing.T) {
+	path := writeHeaderRules(t, "match\n  request set X-Version 1\n")
+	hr, err := newHeaderRules(path)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	hr.apply(req, req.Header, false)
+	assert.Equal(t, "1", req.Header.Get("X-Version"))
+	// Invalid rules are ignored.
+	require.NoError(t, os.WriteFile(path, []byte("oops\n"), 0644))
+	hr.reload()
+	hr.apply(req, req.Header, false)
+	assert.Equal(t, "1", req.Header.Get("X-Version"))
+	require.NoError(t, os.WriteFile(path, []byte("match\n  request set X-Version 2\n"), 0644))
+	hr.reload()
+	hr.apply(req, req.Header, false)
+	assert.Equal(t, "2", req.Header.Get("X-Version"))
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "alpaca", req.Header.Get("User-Agent"))
+		assert.NotContains(t, req.Header, "X-Forwarded-For")
+		w.Header().Set("Server", "test")
+	}))
+	defer server.Close()
+	hr, err := newHeaderRules(writeHeaderRules(t, `match method=GET
+  request set User-Agent alpaca
+  request remove X-Forwarded-For
+  response remove Server
+`))
+	require.NoError(t, err)
+	ph := newDirectProxy()
+	ph.rules = hr
+	proxy := httptest.NewServer(ph)
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, resp.Header, "Server")
+}
@@ -0,0 +1,208 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Matches the proxies that appear literally in a PAC script, e.g. "PROXY proxy.test:8080".
+var proxyInPAC = regexp.MustCompile(`\b(PROXY|HTTPS?)\s+([A-Za-z0-9.\-]+(:\d+)?|\[[0-9A-Fa-f:.]+\](:\d+)?)`)
+
+// proxiesInPAC returns the proxies that appear in the source of a PAC script. Proxies that the
+// script builds at run time won't be found, but the health checker also learns about those as
+// they are used.
+func proxiesInPAC(pacjs []byte) []*url.URL {
+	var proxies []*url.URL
+	for _, match := range proxyInPAC.FindAllSubmatch(pacjs, -1) {
+		entries, _ := parseProxyList(string(match[1]) + " " + string(match[2]))
+		for _, entry := range entries {
+			proxies = append(proxies, entry.proxy)
+		}
+	}
+	return proxies
+}
+
+// healthChecker periodically checks whether the proxies used by the current PAC script are
+// working, so that dead proxies can be blocked before a request fails, and recovered proxies
+// can be unblocked without waiting for them to expire from the blocklist.
+type healthChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	// If non-empty, a CONNECT request for this host:port is sent to each proxy (authenticated
+	// using auth, if the proxy asks for it). Otherwise, we only check that each proxy accepts
+	// TCP connections.
+	target  string
+	auth    *authenticator
+	tls     *proxyTLS // Used to connect to HTTPS proxies (for CONNECT requests)
+	dial    func(network, addr string, timeout time.Duration) (net.Conn, error)
+	connect func(proxy *url.URL) error
+	// Callbacks into the ProxyFinder. Proxies are only checked while active returns true.
+	active  func() bool
+	block   func(string)
+	unblock func(string)
+	proxies map[string]*url.URL // The proxies to check, keyed by host:port
+	healthy map[string]bool     // The result of the last check of each proxy
+	mux     sync.Mutex
+}
+
+func newHealthChecker(interval time.Duration, target string, auth *authenticator) *healthChecker {
+	hc := &healthChecker{
+		interval: interval,
+		timeout:  5 * time.Second,
+		target:   target,
+		auth:     auth,
+		dial:     net.DialTimeout,
+		proxies:  map[string]*url.URL{},
+		healthy:  map[string]bool{},
+	}
+	hc.connect = hc.connectToTarget
+	return hc
+}
+
+func (hc *healthChecker) start() {
+	go func() {
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if hc.active == nil || hc.active() {
+				hc.checkAll()
+			}
+		}
+	}()
+}
+
+// setProxies replaces the set of proxies to check, e.g. when a new PAC script is loaded.
+func (hc *healthChecker) setProxies(proxies []*url.URL) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	hc.proxies = map[string]*url.URL{}
+	for _, proxy := range proxies {
+		hc.proxies[proxy.Host] = proxy
+	}
+	for host := range hc.healthy {
+		if _, ok := hc.proxies[host]; !ok {
+			delete(hc.healthy, host)
+		}
+	}
+}
+
+// observe adds a proxy that was returned by the PAC script to the set of proxies to check.
+func (hc *healthChecker) observe(proxy *url.URL) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if _, ok := hc.proxies[proxy.Host]; !ok {
+		hc.proxies[proxy.Host] = proxy
+	}
+}
+
+func (hc *healthChecker) checkAll() {
+	hc.mux.Lock()
+	proxies := make([]*url.URL, 0, len(hc.proxies))
+	for _, proxy := range hc.proxies {
+		proxies = append(proxies, proxy)
+	}
+	hc.mux.Unlock()
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Host < proxies[j].Host })
+	for _, proxy := range proxies {
+		hc.check(proxy)
+	}
+}
+
+func (hc *healthChecker) check(proxy *url.URL) {
+	err := hc.probe(proxy)
+	// Apply the result with the lock held, so that it's dropped if a new PAC script stopped
+	// using the proxy while it was being checked.
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if _, ok := hc.proxies[proxy.Host]; !ok {
+		return
+	}
+	healthy, known := hc.healthy[proxy.Host]
+	hc.healthy[proxy.Host] = err == nil
+	if err != nil {
+		if !known || healthy {
+			log.Printf("Health check: proxy %s is down, blocking it: %v", proxy.Host, err)
+		}
+		hc.block(proxy.Host)
+	} else {
+		if !known || !healthy {
+			log.Printf("Health check: proxy %s is up", proxy.Host)
+		}
+		hc.unblock(proxy.Host)
+	}
+}
+
+func (hc *healthChecker) probe(proxy *url.URL) error {
+	conn, err := hc.dial("tcp", proxy.Host, hc.timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	if hc.target == "" {
+		return nil
+	}
+	return hc.connect(proxy)
+}
+
+// connectToTarget sends a CONNECT request for the target through the proxy, and checks that
+// the proxy accepts it.
+func (hc *healthChecker) connectToTarget(proxy *url.URL) error {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: hc.target},
+		Host:       hc.target,
+		Header:     http.Header{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	tr := transport{tls: hc.tls}
+	defer tr.Close()
+	deadline := time.Now().Add(hc.timeout)
+	if err := tr.dial(proxy); err != nil {
+		return err
+	} else if err := tr.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired && hc.auth != nil {
+		if err := tr.dial(proxy); err != nil {
+			return err
+		} else if err := tr.conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+		if resp, err = hc.auth.do(req, &tr); err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s failed: %s", hc.target, resp.Status)
+	}
+	return nil
+}
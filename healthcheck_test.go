@@ -0,0 +1,113 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxiesInPAC(t *testing.T) {
+	pacjs := []byte(`function FindProxyForURL(url, host) {
+		if (url.substring(0, 5) == "http:")
+			return "PROXY proxy1.test:8080; PROXY proxy2.test";
+		if (isPlainHostName(host))
+			return "HTTPS secure.test:443; DIRECT";
+		return "PROXY " + host + ":80";
+	}`)
+	var hosts []string
+	for _, proxy := range proxiesInPAC(pacjs) {
+		hosts = append(hosts, proxy.String())
+	}
+	assert.Equal(t, []string{
+		"http://proxy1.test:8080", "http://proxy2.test:80", "https://secure.test:443",
+	}, hosts)
+}
+
+func TestHealthCheck(t *testing.T) {
+	hc := newHealthChecker(time.Minute, "", nil)
+	up := map[string]bool{"proxy1.test:80": true}
+	hc.dial = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		if !up[addr] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	b := newBlocklist()
+	hc.block = b.add
+	hc.unblock = b.remove
+	hc.setProxies([]*url.URL{{Scheme: "http", Host: "proxy1.test:80"}})
+	hc.observe(&url.URL{Scheme: "http", Host: "proxy2.test:80"})
+
+	// Dead proxies are blocked before anything tries to use them.
+	hc.checkAll()
+	assert.False(t, b.contains("proxy1.test:80"))
+	assert.True(t, b.contains("proxy2.test:80"))
+
+	// Recovered proxies are unblocked straight away.
+	up["proxy2.test:80"] = true
+	hc.checkAll()
+	assert.False(t, b.contains("proxy2.test:80"))
+
+	// Proxies that aren't in the new PAC script are no longer checked.
+	hc.setProxies(nil)
+	up["proxy1.test:80"] = false
+	hc.checkAll()
+	assert.False(t, b.contains("proxy1.test:80"))
+}
+
+func TestHealthCheckProxyRemovedDuringCheck(t *testing.T) {
+	hc := newHealthChecker(time.Minute, "", nil)
+	b := newBlocklist()
+	hc.block = b.add
+	hc.unblock = b.remove
+	hc.setProxies([]*url.URL{{Scheme: "http", Host: "proxy.test:80"}})
+	hc.dial = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		// A new PAC script is loaded while the proxy is being checked.
+		hc.setProxies(nil)
+		return nil, errors.New("connection refused")
+	}
+	hc.checkAll()
+	assert.False(t, b.contains("proxy.test:80"))
+	assert.Empty(t, hc.healthy)
+}
+
+func TestHealthCheckConnect(t *testing.T) {
+	var status int
+	var target string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target = req.Host
+		w.WriteHeader(status)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	hc := newHealthChecker(time.Minute, "www.test:443", nil)
+	status = http.StatusOK
+	assert.NoError(t, hc.probe(proxyURL))
+	assert.Equal(t, "www.test:443", target)
+	status = http.StatusForbidden
+	assert.EqualError(t, hc.probe(proxyURL), "CONNECT www.test:443 failed: 403 Forbidden")
+}
@@ -21,9 +21,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var BuildVersion string
@@ -36,13 +40,67 @@ func whoAmI() string {
 	return me.Username
 }
 
+// The URLs that a new PAC script is evaluated for, if none are given using -pac-probe.
+var defaultProbeURLs = []string{"https://example.com/", "http://localhost/"}
+
+// stringList is a flag.Value for flags that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+	if len(os.Args) > 1 && os.Args[1] == "pac" {
+		os.Exit(pacCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	} else if len(os.Args) > 1 && isBlockCommand(os.Args[1]) {
+		os.Exit(blockCommand(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
+	} else if len(os.Args) > 1 && os.Args[1] == "setup" {
+		os.Exit(setupCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	host := flag.String("l", "localhost", "address to listen on")
 	port := flag.Int("p", 3128, "port number to listen on")
-	pacurl := flag.String("C", "", "url of proxy auto-config (pac) file")
+	var pacurls stringList
+	flag.Var(&pacurls, "C", "url of proxy auto-config (pac) file (repeat to give alternative urls)")
 	domain := flag.String("d", "", "domain of the proxy account (for NTLM auth)")
 	username := flag.String("u", whoAmI(), "username of the proxy account (for NTLM auth)")
+	ipv6 := flag.Bool("ipv6", false, "support IPv6 addresses in isInNet, dnsResolve and myIpAddress")
+	dnsTTL := flag.Duration("dns-ttl", time.Minute, "how long to cache DNS lookups made by the pac file")
+	dnsTimeout := flag.Duration("dns-timeout", 5*time.Second, "timeout for DNS lookups made by the pac file (0 for no limit)")
+	cacheTTL := flag.Duration("pac-cache-ttl", 30*time.Second, "how long to cache pac results for (0 to disable)")
+	pacTimeout := flag.Duration("pac-timeout", 10*time.Second, "maximum time the pac file can run for each url (0 for no limit)")
+	pacFallback := flag.String("pac-fallback", "", "proxy to use if the pac file fails or times out, e.g. \"DIRECT\" or \"PROXY proxy.example.com:8080\" (default: fail the request)")
+	engineName := flag.String("pac-engine", defaultPACEngine, "JavaScript engine used to run the pac file ("+pacEngineNames()+")")
+	checkURL := flag.String("pac-check-url", "", "when using a local (file:) pac file, only use the proxy if this url can be reached directly")
+	connectivity := flag.String("connectivity-check", connectivityPAC, "how to decide whether to use the proxies from the pac file: pac (if the pac file was downloaded), tcp (if a proxy accepts connections) or url (if -connectivity-url can be fetched via a proxy)")
+	connectivityRawURL := flag.String("connectivity-url", "http://example.com/", "url used to choose which proxies to check, for -connectivity-check tcp or url")
+	connectivityInterval := flag.Duration("connectivity-interval", 30*time.Second, "how often to check connectivity, for -connectivity-check tcp or url")
+	healthInterval := flag.Duration("health-check-interval", 30*time.Second, "how often to check the health of the proxies in the pac file (0 to disable)")
+	healthTarget := flag.String("health-check-target", "", "host:port to send a CONNECT request for when checking proxy health (default: only check that the proxy accepts connections)")
+	blockTime := flag.Duration("block-time", defaultBlockPolicy.initialTime, "how long to skip a proxy after it fails (doubled each time it fails again)")
+	maxBlockTime := flag.Duration("max-block-time", defaultBlockPolicy.maxTime, "maximum time to skip a proxy after it fails repeatedly")
+	blockAfter := flag.Int("block-after", defaultBlockPolicy.threshold, "number of consecutive failures before a proxy is skipped")
+	var proxyCAs, proxyServerNames, proxyPins stringList
+	flag.Var(&proxyCAs, "proxy-ca", "file containing CA certificates (in PEM format) to trust for HTTPS proxies, instead of the system's (repeatable)")
+	proxyCert := flag.String("proxy-cert", "", "file containing a client certificate (in PEM format) to present to HTTPS proxies")
+	proxyKey := flag.String("proxy-key", "", "file containing the private key (in PEM format) for -proxy-cert")
+	flag.Var(&proxyServerNames, "proxy-server-name", "server name to send to (and verify for) an HTTPS proxy, as host=name (repeatable)")
+	flag.Var(&proxyPins, "proxy-pin", "public key that HTTPS proxies must present, as sha256//<base64> (repeatable)")
+	var mitmHosts stringList
+	flag.Var(&mitmHosts, "mitm", "intercept TLS connections to hosts matching this pattern, e.g. \"*.example.com\" (repeatable)")
+	mitmDir := flag.String("mitm-ca-dir", defaultMITMDir(), "directory where the CA used for -mitm is stored (and created, if necessary)")
+	rulesFile := flag.String("header-rules", "", "file containing rules for adding, setting and removing request and response headers")
+	directFallback := flag.Bool("served-pac-direct-fallback", false, "make the pac file served at /alpaca.pac fall back to DIRECT when alpaca can't be reached")
+	var pacAddresses stringList
+	flag.Var(&pacAddresses, "served-pac-address", "address to give to clients of the served pac file that connect via an interface, as interface=host[:port], where interface is a name or local IP address (repeatable)")
+	var probes stringList
+	flag.Var(&probes, "pac-probe", "url to test a new pac file with before using it (repeatable, default: "+strings.Join(defaultProbeURLs, ", ")+")")
 	printHash := flag.Bool("H", false, "print hashed NTLM credentials for non-interactive use")
 	version := flag.Bool("version", false, "print version number")
 	flag.Parse()
@@ -52,6 +110,86 @@ func main() {
 		os.Exit(0)
 	}
 
+	engine, err := lookupPACEngine(*engineName)
+	if err != nil {
+		log.Fatalf("Invalid -pac-engine: %v", err)
+	}
+
+	if len(probes) == 0 {
+		probes = defaultProbeURLs
+	}
+	probeURLs := make([]url.URL, len(probes))
+	for i, probe := range probes {
+		u, err := url.Parse(probe)
+		if err != nil || u.Host == "" {
+			log.Fatalf("Invalid -pac-probe %q: expected an absolute URL", probe)
+		}
+		probeURLs[i] = *u
+	}
+
+	connectivityURL, err := url.Parse(*connectivityRawURL)
+	if err != nil || connectivityURL.Host == "" {
+		log.Fatalf("Invalid -connectivity-url %q: expected an absolute URL", *connectivityRawURL)
+	}
+
+	if *pacFallback != "" {
+		if _, invalid := parseProxyList(*pacFallback); len(invalid) > 0 {
+			log.Fatalf("Invalid -pac-fallback %q: can't parse %q", *pacFallback, invalid)
+		}
+	}
+
+	if *blockTime <= 0 || *maxBlockTime < *blockTime {
+		log.Fatalf("Invalid -block-time %v or -max-block-time %v: expected 0 < -block-time <= -max-block-time", *blockTime, *maxBlockTime)
+	} else if *blockAfter < 1 {
+		log.Fatalf("Invalid -block-after %d: must be at least 1", *blockAfter)
+	}
+	policy := blockPolicy{initialTime: *blockTime, maxTime: *maxBlockTime, threshold: *blockAfter}
+
+	addresses := map[string]string{}
+	for _, value := range pacAddresses {
+		iface, addr, ok := strings.Cut(value, "=")
+		if !ok || iface == "" || addr == "" {
+			log.Fatalf("Invalid -served-pac-address %q: expected interface=host[:port]", value)
+		}
+		addresses[iface] = addr
+	}
+
+	var pt *proxyTLS
+	if len(proxyCAs) > 0 || *proxyCert != "" || *proxyKey != "" || len(proxyServerNames) > 0 || len(proxyPins) > 0 {
+		serverNames := map[string]string{}
+		for _, value := range proxyServerNames {
+			host, name, ok := strings.Cut(value, "=")
+			if !ok || host == "" || name == "" {
+				log.Fatalf("Invalid -proxy-server-name %q: expected host=name", value)
+			}
+			serverNames[host] = name
+		}
+		pt, err = newProxyTLS(proxyCAs, *proxyCert, *proxyKey, serverNames, proxyPins)
+		if err != nil {
+			log.Fatalf("Invalid TLS config for HTTPS proxies: %v", err)
+		}
+		pt.watch()
+	}
+
+	var m *mitm
+	if len(mitmHosts) > 0 {
+		m, err = newMITM(mitmHosts, *mitmDir)
+		if err != nil {
+			log.Fatalf("Can't set up TLS interception: %v", err)
+		}
+		log.Printf("Intercepting TLS connections to %s (clients must trust the CA in %s)",
+			mitmHosts.String(), filepath.Join(*mitmDir, mitmCertFile))
+	}
+
+	var rules *headerRules
+	if *rulesFile != "" {
+		rules, err = newHeaderRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Invalid -header-rules: %v", err)
+		}
+		rules.watch()
+	}
+
 	var src credentialSource
 	if *domain != "" {
 		src = fromTerminal().forUser(*domain, *username)
@@ -82,7 +220,42 @@ func main() {
 
 	errch := make(chan error)
 
-	s := createServer(*host, *port, *pacurl, a)
+	runner := &PACRunner{
+		engine:    engine,
+		ipv6:      *ipv6,
+		dns:       newDNSCache(*dnsTTL, *dnsTimeout),
+		cacheTTL:  *cacheTTL,
+		timeout:   *pacTimeout,
+		fallback:  *pacFallback,
+		probeURLs: probeURLs,
+	}
+	fetcher := newPACFetcher(pacurls...)
+	fetcher.checkURL = *checkURL
+	checker, err := newConnectivityChecker(*connectivity, *connectivityURL, *connectivityInterval, runner, pt)
+	if err != nil {
+		log.Fatalf("Invalid -connectivity-check: %v", err)
+	}
+	var health *healthChecker
+	if *healthInterval > 0 {
+		health = newHealthChecker(*healthInterval, *healthTarget, a)
+		health.tls = pt
+	}
+	s := createServer(serverConfig{
+		host:    *host,
+		port:    *port,
+		fetcher: fetcher,
+		checker: checker,
+		health:  health,
+		policy:  policy,
+		auth:    a,
+		runner:  runner,
+		tls:     pt,
+		mitm:    m,
+		rules:   rules,
+
+		directFallback: *directFallback,
+		pacAddresses:   addresses,
+	})
 
 	for _, network := range networks(*host) {
 		go func(network string) {
@@ -99,12 +272,58 @@ func main() {
 	log.Fatal(<-errch)
 }
 
-func createServer(host string, port int, pacurl string, a *authenticator) *http.Server {
-	pacWrapper := NewPACWrapper(PACData{Port: port})
-	proxyFinder := NewProxyFinder(pacurl, pacWrapper)
-	proxyHandler := NewProxyHandler(a, getProxyFromContext, proxyFinder.blockProxy)
+// serverConfig holds the components that createServer wires together.
+type serverConfig struct {
+	host    string
+	port    int
+	fetcher *pacFetcher
+	checker *connectivityChecker // If nil, we're online whenever the PAC file can be downloaded
+	health  *healthChecker       // If nil, health checks are disabled
+	policy  blockPolicy          // If zero, defaultBlockPolicy is used
+	auth    *authenticator
+	runner  *PACRunner
+	tls     *proxyTLS    // If nil, the system's default TLS config is used for HTTPS proxies
+	mitm    *mitm        // If nil, TLS connections are never intercepted
+	rules   *headerRules // If nil, headers aren't rewritten
+	// Whether the served PAC file tells clients to connect directly if alpaca is unreachable
+	directFallback bool
+	// The address to give to clients of the served PAC file, by interface name or local IP
+	pacAddresses map[string]string
+}
+
+func createServer(cfg serverConfig) *http.Server {
+	pacWrapper := NewPACWrapper(PACData{
+		Host:           cfg.host,
+		Port:           cfg.port,
+		DirectFallback: cfg.directFallback,
+		PACFallback:    cfg.runner.fallback,
+		Addresses:      cfg.pacAddresses,
+	})
+	pacWrapper.runner = cfg.runner
+	pacWrapper.proxyHosts = func() []string {
+		// Requests that alpaca changes have to be sent via alpaca.
+		var hosts []string
+		if cfg.mitm != nil {
+			hosts = append(hosts, cfg.mitm.hosts...)
+		}
+		if cfg.rules != nil {
+			hosts = append(hosts, cfg.rules.hosts()...)
+		}
+		return hosts
+	}
+	proxyFinder := NewProxyFinder(cfg.fetcher, cfg.checker, pacWrapper, cfg.runner)
+	if cfg.policy != (blockPolicy{}) {
+		proxyFinder.blocked.setPolicy(cfg.policy)
+	}
+	if cfg.health != nil {
+		proxyFinder.startHealthChecks(cfg.health)
+	}
+	proxyHandler := NewProxyHandler(cfg.auth, getProxyFromContext, proxyFinder.blockProxy, cfg.tls)
+	proxyHandler.mitm = cfg.mitm
+	proxyHandler.rules = cfg.rules
 	mux := http.NewServeMux()
 	pacWrapper.SetupHandlers(mux)
+	proxyFinder.SetupHandlers(mux)
 
 	// build the handler by wrapping middleware upon middleware
 	var handler http.Handler = mux
@@ -112,10 +331,14 @@ func createServer(host string, port int, pacurl string, a *authenticator) *http.
 	handler = proxyHandler.WrapHandler(handler)
 	handler = proxyFinder.WrapHandler(handler)
 	handler = AddContextID(handler)
+	if cfg.mitm != nil {
+		// Decrypted requests are handled just like requests from proxy clients.
+		cfg.mitm.handler = handler
+	}
 
 	return &http.Server{
 		// Set the addr to host(defaults to localhost) : port(defaults to 3128)
-		Addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		Addr:    net.JoinHostPort(cfg.host, strconv.Itoa(cfg.port)),
 		Handler: handler,
 		// TODO: Implement HTTP/2 support. In the meantime, set TLSNextProto to a non-nil
 		// value to disable HTTP/2.
@@ -175,10 +175,11 @@ func TestWithSquid(t *testing.T) {
 
 	// Squid is set up to use a self-signed certificate; configure Alpaca
 	// to accept it.
-	tlsClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
-	c, err := x509.ParseCertificate(cert)
+	caPath := filepath.Join(tempDir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	require.NoError(t, os.WriteFile(caPath, caPEM, 0644))
+	pt, err := newProxyTLS([]string{caPath}, "", "", nil, nil)
 	require.NoError(t, err)
-	tlsClientConfig.RootCAs.AddCert(c)
 
 	// Alpaca logs to stderr by default; redirect to a buffer and write to
 	// the test log in case it's useful for debugging.
@@ -190,7 +191,13 @@ func TestWithSquid(t *testing.T) {
 	// Run (most of) Alpaca in a goroutine.
 	port, err := strconv.Atoi(findAvailablePort(t))
 	require.NoError(t, err)
-	alpaca := createServer("localhost", port, pacServer.URL, nil)
+	alpaca := createServer(serverConfig{
+		host:    "localhost",
+		port:    port,
+		fetcher: newPACFetcher(pacServer.URL),
+		runner:  new(PACRunner),
+		tls:     pt,
+	})
 	go alpaca.ListenAndServe()
 	defer alpaca.Close()
 	waitForServer(alpaca.Addr)
@@ -0,0 +1,345 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+const (
+	mitmCertFile = "mitm-ca.pem"
+	mitmKeyFile  = "mitm-ca-key.pem"
+	// How long the certificates that we generate for each host are valid for.
+	mitmCertLifetime = 7 * 24 * time.Hour
+	// The maximum number of certificates to keep. This is only there to stop the cache from
+	// growing without bound, since a wildcard pattern can match any number of hosts.
+	maxMITMCerts = 1000
+)
+
+// mitm intercepts CONNECT requests for hosts that match one of a set of patterns: rather than
+// tunnelling the connection, it terminates TLS using a certificate signed by its own CA, and
+// passes the decrypted requests to a handler (normally the same handler that serves requests
+// from proxy clients, so that they're sent using the PAC script and authenticated as usual).
+// This only works for clients that trust the CA.
+type mitm struct {
+	hosts    []string // The host patterns, in lower case
+	patterns []glob.Glob
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	handler  http.Handler
+	now      func() time.Time
+	certs    map[string]*tls.Certificate // Certificates that we've issued, keyed by host
+	mux      sync.Mutex
+}
+
+// newMITM returns a mitm that intercepts requests to hosts matching the given patterns (using
+// the same syntax as shExpMatch). The CA certificate and key are read from dir, or generated
+// and saved there if they don't exist yet.
+func newMITM(patterns []string, dir string) (*mitm, error) {
+	m := &mitm{now: time.Now, certs: map[string]*tls.Certificate{}}
+	for _, pattern := range patterns {
+		g, err := glob.Compile(strings.ToLower(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+		m.hosts = append(m.hosts, strings.ToLower(pattern))
+		m.patterns = append(m.patterns, g)
+	}
+	var err error
+	if m.ca, m.caKey, err = loadOrCreateCA(dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func defaultMITMDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "alpaca")
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, mitmCertFile)
+	keyPath := filepath.Join(dir, mitmKeyFile)
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return createCA(certPath, keyPath)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("error loading CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("error loading CA: %s doesn't contain an ECDSA key", keyPath)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading CA: %w", err)
+	}
+	return cert, key, nil
+}
+
+func createCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{CommonName: "Alpaca CA (" + whoAmI() + "@" + hostname + ")"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Created a new CA for TLS interception in %s", certPath)
+	return cert, key, nil
+}
+
+func randomSerialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return n
+}
+
+// intercepts reports whether requests to a host (given as host:port) should be intercepted.
+func (m *mitm) intercepts(addr string) bool {
+	if m == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	for _, g := range m.patterns {
+		if g.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns a certificate for a host, signed by the CA.
+func (m *mitm) certificate(host string) (*tls.Certificate, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := m.now()
+	if cert, ok := m.certs[host]; ok && now.Add(time.Hour).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(mitmCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, key.Public(), m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	if len(m.certs) >= maxMITMCerts {
+		m.sweep(now)
+	}
+	m.certs[host] = cert
+	return cert, nil
+}
+
+// sweep deletes certificates that are about to expire, or all of them if none are. The mutex
+// must be held when calling this function.
+func (m *mitm) sweep(now time.Time) {
+	for host, cert := range m.certs {
+		if !now.Add(time.Hour).Before(cert.Leaf.NotAfter) {
+			delete(m.certs, host)
+		}
+	}
+	if len(m.certs) >= maxMITMCerts {
+		m.certs = map[string]*tls.Certificate{}
+	}
+}
+
+// serve takes over the client connection for a CONNECT request, and serves the requests sent
+// over it (after decrypting them) using the handler. This returns once the client closes the
+// connection.
+func (m *mitm) serve(w http.ResponseWriter, req *http.Request) {
+	id := req.Context().Value(contextKeyID)
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("[%d] Error hijacking response writer", id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	client, _, err := h.Hijack()
+	if err != nil {
+		log.Printf("[%d] Error hijacking connection: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := client.Write(connectionEstablished(req)); err != nil {
+		log.Printf("[%d] Error writing response: %v", id, err)
+		client.Close()
+		return
+	}
+	log.Printf("[%d] Intercepting TLS connection to %s", id, req.Host)
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, inner *http.Request) {
+			// Turn the request into one that a proxy client would have sent. We use the
+			// host from the CONNECT request, since the Host header usually leaves out
+			// the port.
+			inner.URL.Scheme = "https"
+			inner.URL.Host = req.Host
+			m.handler.ServeHTTP(w, inner)
+		}),
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				// Only issue certificates for hosts that we intercept. Otherwise, any
+				// client could get a trusted certificate for any host.
+				name := strings.ToLower(hello.ServerName)
+				if name == "" {
+					return m.certificate(host)
+				} else if name != strings.ToLower(host) && !m.intercepts(name) {
+					return nil, fmt.Errorf("server name %q doesn't match %s", name, req.Host)
+				}
+				return m.certificate(name)
+			},
+		},
+		// Don't offer HTTP/2, since the ProxyHandler doesn't support it.
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		ErrorLog:     log.New(io.Discard, "", 0),
+	}
+	l := newConnListener(client)
+	if err := server.ServeTLS(l, "", ""); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("[%d] Error serving intercepted connection: %v", id, err)
+	}
+}
+
+// connListener is a net.Listener that accepts a single connection, and is closed once that
+// connection has been closed.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	addr   net.Addr
+	once   sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		conns:  make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+		addr:   conn.LocalAddr(),
+	}
+	l.conns <- &listenerConn{conn, l}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenerConn closes its connListener when it's closed.
+type listenerConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *listenerConn) Close() error {
+	c.l.Close()
+	return c.Conn.Close()
+}
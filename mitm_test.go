@@ -0,0 +1,212 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMITMCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "alpaca")
+	m1, err := newMITM(nil, dir)
+	require.NoError(t, err)
+	assert.True(t, m1.ca.IsCA)
+	assert.FileExists(t, filepath.Join(dir, mitmCertFile))
+	assert.FileExists(t, filepath.Join(dir, mitmKeyFile))
+	// The CA is only generated once.
+	m2, err := newMITM(nil, dir)
+	require.NoError(t, err)
+	assert.True(t, m1.ca.Equal(m2.ca))
+	// Don't overwrite a CA that we can't read.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, mitmKeyFile), []byte("garbage"), 0600))
+	_, err = newMITM(nil, dir)
+	assert.Error(t, err)
+}
+
+func TestMITMIntercepts(t *testing.T) {
+	m, err := newMITM([]string{"*.internal.test", "API.Test"}, t.TempDir())
+	require.NoError(t, err)
+	// The patterns are stored in lower case, like the ones that they're compiled to.
+	assert.Equal(t, []string{"*.internal.test", "api.test"}, m.hosts)
+	tests := []struct {
+		addr     string
+		expected bool
+	}{
+		{"www.internal.test:443", true},
+		{"WWW.Internal.Test:8443", true},
+		{"internal.test:443", false},
+		{"api.test:443", true},
+		{"api.test", true},
+		{"www.api.test:443", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, m.intercepts(test.addr), test.addr)
+	}
+	var nilMITM *mitm
+	assert.False(t, nilMITM.intercepts("api.test:443"))
+	_, err = newMITM([]string{"[oops"}, t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestMITMCertificate(t *testing.T) {
+	m, err := newMITM(nil, t.TempDir())
+	require.NoError(t, err)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	for _, host := range []string{"www.test", "192.0.2.1"} {
+		cert, err := m.certificate(host)
+		require.NoError(t, err)
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		assert.NoError(t, err)
+	}
+	// Certificates are reused until they're about to expire.
+	cert1, err := m.certificate("www.test")
+	require.NoError(t, err)
+	cert2, err := m.certificate("www.test")
+	require.NoError(t, err)
+	assert.Same(t, cert1, cert2)
+	now = now.Add(mitmCertLifetime)
+	cert3, err := m.certificate("www.test")
+	require.NoError(t, err)
+	assert.NotSame(t, cert1, cert3)
+	// The cache doesn't grow without bound.
+	for i := 0; i < maxMITMCerts; i++ {
+		_, err := m.certificate(fmt.Sprintf("host%d.test", i))
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, len(m.certs), maxMITMCerts)
+}
+
+func TestMITMServerName(t *testing.T) {
+	m, err := newMITM([]string{"*.internal.test"}, t.TempDir())
+	require.NoError(t, err)
+	m.handler = http.NotFoundHandler()
+	alpaca := httptest.NewServer(http.HandlerFunc(m.serve))
+	defer alpaca.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	tests := []struct {
+		name       string
+		serverName string
+		expected   bool
+	}{
+		{"SameHost", "www.internal.test", true},
+		{"OtherInterceptedHost", "api.internal.test", true},
+		{"NotIntercepted", "bank.example", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", alpaca.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = io.WriteString(conn, "CONNECT www.internal.test:443 HTTP/1.1\r\n"+
+				"Host: www.internal.test:443\r\n\r\n")
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: test.serverName, RootCAs: roots})
+			err = tlsConn.Handshake()
+			if test.expected {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestMITM(t *testing.T) {
+	var r requestLogger
+	tlsServer := httptest.NewTLSServer(r.log("tlsServer", http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, "Hello, "+req.URL.Path)
+		})))
+	defer tlsServer.Close()
+	parentProxy := httptest.NewServer(r.log("parentProxy", newDirectProxy()))
+	defer parentProxy.Close()
+	parentURL := &url.URL{Host: parentProxy.Listener.Addr().String()}
+
+	for _, test := range []struct {
+		name        string
+		pattern     string
+		intercepted bool
+		requests    []string
+	}{
+		{"Intercepted", "127.0.0.1", true, []string{
+			"GET to alpaca", "CONNECT to parentProxy", "GET to tlsServer",
+		}},
+		{"NotIntercepted", "*.internal.test", false, []string{
+			"CONNECT to parentProxy", "GET to tlsServer",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r.clear()
+			m, err := newMITM([]string{test.pattern}, t.TempDir())
+			require.NoError(t, err)
+			ph := NewProxyHandler(nil, getProxyFromContext, func(string) {}, nil)
+			ph.tunnel.TLSClientConfig = tlsConfig(tlsServer)
+			ph.mitm = m
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodConnect {
+					// Only log the decrypted requests.
+					r.requests = append(r.requests, "GET to alpaca")
+				}
+				ctx := context.WithValue(req.Context(), contextKeyProxies, []*url.URL{parentURL})
+				ph.ServeHTTP(w, withProxy(req.WithContext(ctx), parentURL))
+			})
+			m.handler = handler
+			alpaca := httptest.NewServer(handler)
+			defer alpaca.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(m.ca)
+			roots.AddCert(tlsServer.Certificate())
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy:           proxyServer(t, alpaca),
+					TLSClientConfig: &tls.Config{RootCAs: roots},
+				},
+			}
+			resp, err := client.Get(tlsServer.URL + "/client")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "Hello, /client", string(body))
+			issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName
+			assert.Equal(t, test.intercepted, issuer == m.ca.Subject.CommonName)
+			assert.Equal(t, test.requests, r.requests)
+		})
+	}
+}
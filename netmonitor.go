@@ -45,7 +45,7 @@ func (nm *netMonitorImpl) addrsChanged() bool {
 	// Probe for routes to a set of remote addresses. These addresses are
 	// the same as those used by myIpAddressEx.
 	// TODO: Cache the results so they don't need to be recalculated in
-	// myIpAddress (and myIpAddressEx, when implemented).
+	// myIpAddress and myIpAddressEx.
 	remotes := []string{
 		"8.8.8.8", "2001:4860:4860::8888", // public addresses
 		"10.0.0.0", "172.16.0.0", "192.168.0.0", "FC00::", // private addresses
@@ -0,0 +1,509 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"github.com/dop251/goja/token"
+)
+
+// noProxyRule is a condition in a PAC script that leads to DIRECT, and the NO_PROXY entries
+// that match the same hosts.
+type noProxyRule struct {
+	line    int
+	source  string   // The condition, as it appears in the PAC script
+	entries []string // The equivalent NO_PROXY entries, if the condition could be translated
+	// Why the condition couldn't be translated (if entries is empty), or how the entries differ
+	// from the condition (if they match other hosts too, or miss some)
+	reason string
+}
+
+func (r noProxyRule) String() string {
+	return fmt.Sprintf("line %d: %s: %s", r.line, r.source, r.reason)
+}
+
+// findDirectRules finds the conditions under which a PAC script's FindProxyForURLEx (or
+// FindProxyForURL) function returns DIRECT, and translates the ones that it can into NO_PROXY
+// entries. It only understands the common patterns (dnsDomainIs, shExpMatch, isPlainHostName,
+// isInNet and comparisons with the host, combined with ||) at the top level of the function.
+func findDirectRules(pacjs []byte) ([]noProxyRule, error) {
+	program, err := parser.ParseFile(nil, "", string(pacjs), 0)
+	if err != nil {
+		return nil, err
+	}
+	a := &pacAnalyzer{
+		src:     string(pacjs),
+		program: program,
+		hosts:   map[string]bool{},
+		ips:     map[string]bool{},
+		consts:  map[string]string{},
+	}
+	a.declarations(program.Body)
+	fn := findEntryPoint(program.Body, "FindProxyForURLEx")
+	if fn == nil {
+		fn = findEntryPoint(program.Body, "FindProxyForURL")
+	}
+	if fn == nil || fn.Body == nil {
+		return nil, errors.New("can't find FindProxyForURL in the PAC script")
+	}
+	if params := fn.ParameterList.List; len(params) >= 2 {
+		if id, ok := params[1].Target.(*ast.Identifier); ok {
+			a.hosts[id.Name.String()] = true
+		}
+	}
+	a.declarations(fn.Body.List)
+	a.statements(fn.Body.List, false)
+	return a.rules, nil
+}
+
+// findEntryPoint finds the function with the given name, however it's defined.
+func findEntryPoint(body []ast.Statement, name string) *ast.FunctionLiteral {
+	var found *ast.FunctionLiteral
+	for _, stmt := range body {
+		switch s := stmt.(type) {
+		case *ast.FunctionDeclaration:
+			if s.Function.Name != nil && s.Function.Name.Name.String() == name {
+				found = s.Function
+			}
+		case *ast.VariableStatement:
+			for _, b := range s.List {
+				if id, ok := b.Target.(*ast.Identifier); ok && id.Name.String() == name {
+					if fn, ok := b.Initializer.(*ast.FunctionLiteral); ok {
+						found = fn
+					}
+				}
+			}
+		case *ast.ExpressionStatement:
+			if assign, ok := s.Expression.(*ast.AssignExpression); ok {
+				if id, ok := assign.Left.(*ast.Identifier); ok && id.Name.String() == name {
+					if fn, ok := assign.Right.(*ast.FunctionLiteral); ok {
+						found = fn
+					}
+				}
+			}
+		}
+	}
+	return found
+}
+
+type pacAnalyzer struct {
+	src     string
+	program *ast.Program
+	hosts   map[string]bool   // Variables holding the host (or a lowercase copy of it)
+	ips     map[string]bool   // Variables holding the host's IP address
+	consts  map[string]string // Variables holding strings (e.g. var direct = "DIRECT")
+	rules   []noProxyRule
+}
+
+// declarations records the variables that hold the host, its IP address or a string.
+func (a *pacAnalyzer) declarations(body []ast.Statement) {
+	for _, stmt := range body {
+		var bindings []*ast.Binding
+		switch s := stmt.(type) {
+		case *ast.VariableStatement:
+			bindings = s.List
+		case *ast.LexicalDeclaration:
+			bindings = s.List
+		}
+		for _, b := range bindings {
+			id, ok := b.Target.(*ast.Identifier)
+			if !ok || b.Initializer == nil {
+				continue
+			}
+			name := id.Name.String()
+			if a.isHost(b.Initializer) {
+				a.hosts[name] = true
+			} else if a.isIP(b.Initializer) {
+				a.ips[name] = true
+			} else if lit, ok := b.Initializer.(*ast.StringLiteral); ok {
+				a.consts[name] = lit.Value.String()
+			}
+		}
+	}
+}
+
+// statements looks for the statements that return DIRECT. If nested is true, the statements
+// only run when an enclosing condition is true.
+func (a *pacAnalyzer) statements(list []ast.Statement, nested bool) {
+	for _, stmt := range list {
+		a.statement(stmt, nested)
+	}
+}
+
+func (a *pacAnalyzer) statement(stmt ast.Statement, nested bool) {
+	switch s := stmt.(type) {
+	case *ast.BlockStatement:
+		a.statements(s.List, nested)
+	case *ast.IfStatement:
+		if a.returnsDirect(s.Consequent) && !nested {
+			a.condition(s.Test)
+		} else if a.returnsDirect(s.Consequent) {
+			a.flag(s.Test, "it depends on an enclosing condition")
+		} else {
+			a.statement(s.Consequent, true)
+		}
+		if s.Alternate != nil {
+			a.statement(s.Alternate, nested)
+		}
+	case *ast.ReturnStatement:
+		if cond, ok := s.Argument.(*ast.ConditionalExpression); ok {
+			if a.isDirect(cond.Consequent) && !nested {
+				a.condition(cond.Test)
+			} else if a.isDirect(cond.Consequent) {
+				a.flag(cond.Test, "it depends on an enclosing condition")
+			}
+			if a.isDirect(cond.Alternate) {
+				a.flag(cond.Test, "everything that doesn't match goes directly, which NO_PROXY can't express")
+			}
+		} else if a.isDirect(s.Argument) && nested {
+			a.flag(s, "it depends on an enclosing condition")
+		} else if a.isDirect(s.Argument) {
+			a.flag(s, "everything else goes directly, which NO_PROXY can't express")
+		} else if _, ok := a.stringValue(s.Argument); !ok && s.Argument != nil {
+			a.flag(s, "can't tell whether it returns DIRECT")
+		}
+	}
+}
+
+// returnsDirect reports whether a statement just returns DIRECT.
+func (a *pacAnalyzer) returnsDirect(stmt ast.Statement) bool {
+	if block, ok := stmt.(*ast.BlockStatement); ok && len(block.List) == 1 {
+		stmt = block.List[0]
+	}
+	ret, ok := stmt.(*ast.ReturnStatement)
+	return ok && a.isDirect(ret.Argument)
+}
+
+// isDirect reports whether an expression is a string that alpaca would treat as DIRECT.
+func (a *pacAnalyzer) isDirect(expr ast.Expression) bool {
+	s, ok := a.stringValue(expr)
+	if !ok {
+		return false
+	}
+	entries, _ := parseProxyList(s)
+	return len(entries) > 0 && entries[0].proxy == nil
+}
+
+func (a *pacAnalyzer) stringValue(expr ast.Expression) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.StringLiteral:
+		return e.Value.String(), true
+	case *ast.Identifier:
+		s, ok := a.consts[e.Name.String()]
+		return s, ok
+	}
+	return "", false
+}
+
+// isHost reports whether an expression is the host (or a lowercase copy of it).
+func (a *pacAnalyzer) isHost(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		return a.hosts[e.Name.String()]
+	case *ast.CallExpression:
+		dot, ok := e.Callee.(*ast.DotExpression)
+		return ok && len(e.ArgumentList) == 0 && dot.Identifier.Name == "toLowerCase" && a.isHost(dot.Left)
+	}
+	return false
+}
+
+// isIP reports whether an expression is the host's IP address (or the host itself, which isInNet
+// resolves).
+func (a *pacAnalyzer) isIP(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		return a.ips[e.Name.String()] || a.hosts[e.Name.String()]
+	case *ast.CallExpression:
+		name := calleeName(e)
+		return (name == "dnsResolve" || name == "dnsResolveEx") && len(e.ArgumentList) == 1 &&
+			a.isHost(e.ArgumentList[0])
+	}
+	return false
+}
+
+func calleeName(call *ast.CallExpression) string {
+	if id, ok := call.Callee.(*ast.Identifier); ok {
+		return id.Name.String()
+	}
+	return ""
+}
+
+// condition records the rules in a condition that leads to DIRECT.
+func (a *pacAnalyzer) condition(expr ast.Expression) {
+	if bin, ok := expr.(*ast.BinaryExpression); ok && bin.Operator == token.LOGICAL_OR {
+		a.condition(bin.Left)
+		a.condition(bin.Right)
+		return
+	}
+	entries, reason := a.translate(expr)
+	if len(entries) == 0 {
+		a.flag(expr, reason)
+		return
+	}
+	a.rules = append(a.rules, noProxyRule{line: a.line(expr), source: a.source(expr),
+		entries: entries, reason: reason})
+}
+
+func (a *pacAnalyzer) flag(node ast.Node, reason string) {
+	a.rules = append(a.rules, noProxyRule{line: a.line(node), source: a.source(node), reason: reason})
+}
+
+func (a *pacAnalyzer) line(node ast.Node) int {
+	return a.program.File.Position(int(node.Idx0()) - a.program.File.Base()).Line
+}
+
+func (a *pacAnalyzer) source(node ast.Node) string {
+	base := a.program.File.Base()
+	start, end := int(node.Idx0())-base, int(node.Idx1())-base
+	if start < 0 || end > len(a.src) || start > end {
+		return "?"
+	}
+	return strings.Join(strings.Fields(a.src[start:end]), " ")
+}
+
+// translate returns the NO_PROXY entries that match the same hosts as a condition, or the reason
+// that it can't. If the entries only roughly match the same hosts, it returns both.
+func (a *pacAnalyzer) translate(expr ast.Expression) ([]string, string) {
+	switch e := expr.(type) {
+	case *ast.BinaryExpression:
+		if e.Operator == token.LOGICAL_AND {
+			return nil, "NO_PROXY can't express conditions combined with &&"
+		} else if e.Operator != token.EQUAL && e.Operator != token.STRICT_EQUAL {
+			return nil, "unrecognised condition"
+		}
+		if s, ok := a.stringValue(e.Right); ok && a.isHost(e.Left) {
+			return []string{s}, ""
+		} else if s, ok := a.stringValue(e.Left); ok && a.isHost(e.Right) {
+			return []string{s}, ""
+		}
+		return nil, "it doesn't compare the host with a string"
+	case *ast.UnaryExpression:
+		if e.Operator == token.NOT {
+			return nil, "NO_PROXY can't express negated conditions"
+		}
+	case *ast.CallExpression:
+		return a.translateCall(e)
+	}
+	return nil, "unrecognised condition"
+}
+
+func (a *pacAnalyzer) translateCall(call *ast.CallExpression) ([]string, string) {
+	args := call.ArgumentList
+	arg := func(i int) string {
+		if i >= len(args) {
+			return ""
+		}
+		s, _ := a.stringValue(args[i])
+		return s
+	}
+	switch name := calleeName(call); name {
+	case "isPlainHostName":
+		return nil, "NO_PROXY can't match plain host names (without a domain)"
+	case "dnsDomainIs", "localHostOrDomainIs":
+		if len(args) != 2 || !a.isHost(args[0]) {
+			return nil, "it doesn't test the host"
+		} else if arg(1) == "" {
+			return nil, "the domain isn't a string"
+		} else if name == "localHostOrDomainIs" {
+			// This is an exact match, but NO_PROXY entries are suffix matches.
+			return []string{arg(1)}, fmt.Sprintf("NO_PROXY also matches subdomains of %s", arg(1))
+		}
+		return []string{arg(1)}, ""
+	case "shExpMatch":
+		if len(args) != 2 || !a.isHost(args[0]) {
+			return nil, "it doesn't test the host (NO_PROXY can't match URLs)"
+		} else if arg(1) == "" {
+			return nil, "the pattern isn't a string"
+		}
+		return translatePattern(arg(1))
+	case "isInNet":
+		if len(args) != 3 || !a.isIP(args[0]) {
+			return nil, "it doesn't test the host's address"
+		}
+		prefix, err := maskToPrefix(arg(1), arg(2))
+		if err != nil {
+			return nil, err.Error()
+		}
+		return []string{prefix}, ipOnlyReason(prefix)
+	case "isInNetEx":
+		if len(args) != 2 || !a.isIP(args[0]) {
+			return nil, "it doesn't test the host's address"
+		}
+		prefix, err := netip.ParsePrefix(arg(1))
+		if err != nil {
+			return nil, fmt.Sprintf("invalid prefix %q", arg(1))
+		}
+		return []string{prefix.Masked().String()}, ipOnlyReason(prefix.Masked().String())
+	case "":
+		return nil, "unrecognised condition"
+	default:
+		return nil, "unrecognised function " + name
+	}
+}
+
+// ipOnlyReason explains why an address range in NO_PROXY doesn't quite match the same hosts as
+// isInNet, which resolves host names.
+func ipOnlyReason(prefix string) string {
+	return fmt.Sprintf("NO_PROXY only matches IP literals; host names resolving into %s still go via the proxy",
+		prefix)
+}
+
+// translatePattern translates a shExpMatch pattern for the host into NO_PROXY entries.
+func translatePattern(pattern string) ([]string, string) {
+	pattern = strings.ToLower(pattern)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, ""
+	} else if domain, ok := strings.CutPrefix(pattern, "*."); ok && !strings.ContainsAny(domain, "*?[") {
+		return []string{"." + domain}, ""
+	} else if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+		// An IP address prefix, e.g. 192.168.*
+		octets := strings.Split(prefix, ".")
+		if len(octets) <= 3 {
+			addr := make([]string, 4)
+			valid := true
+			for i := range addr {
+				addr[i] = "0"
+				if i < len(octets) {
+					n, err := strconv.Atoi(octets[i])
+					valid = valid && err == nil && n >= 0 && n <= 255 && octets[i] == strconv.Itoa(n)
+					addr[i] = octets[i]
+				}
+			}
+			if valid {
+				return []string{fmt.Sprintf("%s/%d", strings.Join(addr, "."), 8*len(octets))}, ""
+			}
+		}
+	}
+	return nil, fmt.Sprintf("NO_PROXY can't express the pattern %q", pattern)
+}
+
+// maskToPrefix converts an IPv4 address and netmask (as used by isInNet) to a prefix in CIDR
+// notation.
+func maskToPrefix(addr, mask string) (string, error) {
+	ip := net.ParseIP(addr).To4()
+	m := net.ParseIP(mask).To4()
+	if ip == nil || m == nil {
+		return "", fmt.Errorf("invalid address or mask (%q, %q)", addr, mask)
+	}
+	ones, bits := net.IPMask(m).Size()
+	if bits == 0 {
+		return "", fmt.Errorf("NO_PROXY can't express the non-contiguous mask %s", mask)
+	}
+	network := net.IPNet{IP: ip.Mask(net.IPMask(m)), Mask: net.CIDRMask(ones, bits)}
+	return network.String(), nil
+}
+
+// noProxyMatches reports whether a NO_PROXY entry matches a host.
+func noProxyMatches(entry, host string) bool {
+	host = strings.ToLower(host)
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && prefix.Contains(addr)
+	} else if strings.HasPrefix(entry, ".") {
+		return strings.HasSuffix(host, entry)
+	}
+	return host == strings.ToLower(entry)
+}
+
+// sampleHost returns a host that a NO_PROXY entry matches, for testing it against the PAC script.
+func sampleHost(entry string) string {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		addr := prefix.Addr()
+		if prefix.Bits() < addr.BitLen() {
+			addr = addr.Next()
+		}
+		return addr.String()
+	} else if strings.HasPrefix(entry, ".") {
+		return "noproxy-check" + entry
+	}
+	return entry
+}
+
+// generateNoProxy works out a NO_PROXY value for a PAC script. The rules found in the script
+// are checked by running it (since an earlier rule could send a host via a proxy), along with
+// any other candidate hosts. It returns the entries, and the rules that couldn't be
+// translated (with no entries) or that only translated roughly.
+func generateNoProxy(pr *PACRunner, pacjs []byte, candidates []string) ([]string, []noProxyRule, error) {
+	rules, err := findDirectRules(pacjs)
+	if err != nil {
+		return nil, nil, err
+	}
+	direct := func(host string) (bool, string) {
+		u := url.URL{Scheme: "http", Host: host, Path: "/"}
+		if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		}
+		result, err := pr.FindProxyForURL(u)
+		if err != nil {
+			return false, err.Error()
+		}
+		entries, _ := parseProxyList(result)
+		return len(entries) > 0 && entries[0].proxy == nil, strconv.Quote(result)
+	}
+	var entries []string
+	var flagged []noProxyRule
+	add := func(entry string) {
+		for _, e := range entries {
+			if e == entry {
+				return
+			}
+		}
+		entries = append(entries, entry)
+	}
+	for _, rule := range rules {
+		if len(rule.entries) == 0 {
+			flagged = append(flagged, rule)
+			continue
+		}
+		ok := true
+		for _, entry := range rule.entries {
+			if isDirect, result := direct(sampleHost(entry)); !isDirect {
+				rule.reason = fmt.Sprintf("the PAC script doesn't send %s directly (it returned %s)",
+					sampleHost(entry), result)
+				ok = false
+			}
+		}
+		if !ok {
+			rule.entries = nil
+			flagged = append(flagged, rule)
+			continue
+		}
+		for _, entry := range rule.entries {
+			add(entry)
+		}
+		if rule.reason != "" {
+			flagged = append(flagged, rule)
+		}
+	}
+	for _, host := range candidates {
+		covered := false
+		for _, entry := range entries {
+			covered = covered || noProxyMatches(entry, host)
+		}
+		if isDirect, _ := direct(host); isDirect && !covered {
+			add(host)
+		}
+	}
+	return entries, flagged, nil
+}
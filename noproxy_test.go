@@ -0,0 +1,178 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindDirectRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		pac     string
+		entries []string // The entries from all of the translated rules
+		reasons []string // The reasons for the rules that weren't translated exactly
+	}{
+		{"Domains", `function FindProxyForURL(url, host) {
+  if (dnsDomainIs(host, ".a.test") || localHostOrDomainIs(host, "www.b.test") || host == "c.test")
+    return "DIRECT";
+  return "PROXY proxy.test:80";
+}`, []string{".a.test", "www.b.test", "c.test"}, []string{
+			"NO_PROXY also matches subdomains of www.b.test",
+		}},
+		{"Patterns", `function FindProxyForURL(url, host) {
+  var h = host.toLowerCase();
+  if (shExpMatch(h, "*.a.test")) return "DIRECT";
+  if (shExpMatch(h, "192.168.*")) { return "DIRECT"; }
+  if (shExpMatch(h, "a*.test")) return "DIRECT";
+  if (shExpMatch(url, "http://*")) return "DIRECT";
+  return "PROXY proxy.test:80";
+}`, []string{".a.test", "192.168.0.0/16"}, []string{
+			`NO_PROXY can't express the pattern "a*.test"`,
+			"it doesn't test the host (NO_PROXY can't match URLs)",
+		}},
+		{"Networks", `var direct = "DIRECT";
+var FindProxyForURL = function (url, host) {
+  var ip = dnsResolve(host);
+  if (isInNet(ip, "10.0.0.0", "255.0.0.0")) return direct;
+  if (isInNet(host, "172.16.0.0", "255.240.0.0")) return direct;
+  if (isInNet(myIpAddress(), "192.0.2.0", "255.255.255.0")) return direct;
+  if (isInNet(host, "10.0.0.0", "255.0.255.0")) return direct;
+  return "PROXY proxy.test:80";
+}`, []string{"10.0.0.0/8", "172.16.0.0/12"}, []string{
+			"NO_PROXY only matches IP literals; host names resolving into 10.0.0.0/8 still go via the proxy",
+			"NO_PROXY only matches IP literals; host names resolving into 172.16.0.0/12 still go via the proxy",
+			"it doesn't test the host's address",
+			"NO_PROXY can't express the non-contiguous mask 255.0.255.0",
+		}},
+		{"Ex", `function FindProxyForURL(url, host) { return "DIRECT"; }
+function FindProxyForURLEx(url, host) {
+  return isInNetEx(host, "2001:db8::1/32") ? "DIRECT" : "PROXY proxy.test:80";
+}`, []string{"2001:db8::/32"}, []string{
+			"NO_PROXY only matches IP literals; host names resolving into 2001:db8::/32 still go via the proxy",
+		}},
+		{"Untranslatable", `function FindProxyForURL(url, host) {
+  if (isPlainHostName(host)) return "DIRECT";
+  if (dnsDomainIs(host, ".a.test") && !dnsDomainIs(host, "www.a.test")) return "DIRECT";
+  if (!isResolvable(host)) return "DIRECT";
+  if (weekdayRange("SAT", "SUN")) return "DIRECT";
+  if (dnsDomainIs(host, ".b.test")) {
+    if (url.substring(0, 5) == "http:") return "DIRECT";
+  }
+  return helper(host);
+}`, nil, []string{
+			"NO_PROXY can't match plain host names (without a domain)",
+			"NO_PROXY can't express conditions combined with &&",
+			"NO_PROXY can't express negated conditions",
+			"unrecognised function weekdayRange",
+			"it depends on an enclosing condition",
+			"can't tell whether it returns DIRECT",
+		}},
+		{"DirectByDefault", `function FindProxyForURL(url, host) {
+  if (dnsDomainIs(host, ".a.test")) return "PROXY proxy.test:80";
+  return "DIRECT";
+}`, nil, []string{"everything else goes directly, which NO_PROXY can't express"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := findDirectRules([]byte(test.pac))
+			require.NoError(t, err)
+			var entries, reasons []string
+			for _, rule := range rules {
+				entries = append(entries, rule.entries...)
+				if rule.reason != "" {
+					reasons = append(reasons, rule.reason)
+				}
+			}
+			assert.Equal(t, test.entries, entries)
+			assert.Equal(t, test.reasons, reasons)
+		})
+	}
+	_, err := findDirectRules([]byte(`function notAPACFile() {}`))
+	assert.EqualError(t, err, "can't find FindProxyForURL in the PAC script")
+}
+
+func TestGenerateNoProxy(t *testing.T) {
+	// The second rule never matches www.a.test, because of the first one.
+	pac := `function FindProxyForURL(url, host) {
+  if (host == "www.a.test") return "PROXY proxy.test:80";
+  if (isPlainHostName(host) || localHostOrDomainIs(host, "www.a.test")) return "DIRECT";
+  if (dnsDomainIs(host, ".b.test") || isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";
+  if (host == "direct.test" || host == "localhost") return "DIRECT";
+  return "PROXY proxy.test:80";
+}`
+	pr := &PACRunner{lookupHost: func(host string) ([]string, error) {
+		if net.ParseIP(host) != nil {
+			return []string{host}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}}
+	require.NoError(t, pr.Update([]byte(pac)))
+	candidates := []string{"localhost", "127.0.0.1", "printer", "www.b.test", "www.c.test"}
+	entries, flagged, err := generateNoProxy(pr, []byte(pac), candidates)
+	require.NoError(t, err)
+	assert.Equal(t, []string{".b.test", "10.0.0.0/8", "direct.test", "localhost", "printer"}, entries)
+	require.Len(t, flagged, 3)
+	assert.Equal(t, "line 3: isPlainHostName(host): NO_PROXY can't match plain host names (without a domain)",
+		flagged[0].String())
+	assert.Equal(t, 3, flagged[1].line)
+	assert.Contains(t, flagged[1].reason, `doesn't send www.a.test directly (it returned "PROXY proxy.test:80")`)
+	assert.Empty(t, flagged[1].entries)
+	// The rule for 10.0.0.0/8 is translated, but doesn't quite match the same hosts.
+	assert.Equal(t, 4, flagged[2].line)
+	assert.Equal(t, []string{"10.0.0.0/8"}, flagged[2].entries)
+}
+
+func TestTranslatePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"www.test", "www.test"},
+		{"*.Example.test", ".example.test"},
+		{"10.*", "10.0.0.0/8"},
+		{"192.168.1.*", "192.168.1.0/24"},
+		{"192.168.01.*", ""},
+		{"300.*", ""},
+		{"*.*.test", ""},
+		{"www.?.test", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			entries, reason := translatePattern(test.pattern)
+			if test.expected == "" {
+				assert.Empty(t, entries)
+				assert.NotEmpty(t, reason)
+				return
+			}
+			assert.Equal(t, []string{test.expected}, entries)
+		})
+	}
+}
+
+func TestNoProxyMatches(t *testing.T) {
+	assert.True(t, noProxyMatches(".a.test", "www.A.test"))
+	assert.False(t, noProxyMatches(".a.test", "a.test"))
+	assert.True(t, noProxyMatches("a.test", "A.TEST"))
+	assert.True(t, noProxyMatches("10.0.0.0/8", "10.1.2.3"))
+	assert.False(t, noProxyMatches("10.0.0.0/8", "www.test"))
+	assert.Equal(t, "10.0.0.1", sampleHost("10.0.0.0/8"))
+	assert.Equal(t, "192.0.2.1", sampleHost("192.0.2.1/32"))
+	assert.Equal(t, "noproxy-check.a.test", sampleHost(".a.test"))
+}
@@ -0,0 +1,272 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnsOverrides is a flag.Value that collects host=addr[,addr...] pairs. A host with no
+// addresses (e.g. "-dns host=") is treated as not resolvable.
+type dnsOverrides map[string][]string
+
+func (d dnsOverrides) String() string {
+	var pairs []string
+	for host, addrs := range d {
+		pairs = append(pairs, host+"="+strings.Join(addrs, ","))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (d dnsOverrides) Set(value string) error {
+	host, addrs, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return errors.New("expected host=addr[,addr...]")
+	}
+	d[host] = nil
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr == "" {
+			continue
+		} else if net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid IP address: %q", addr)
+		}
+		d[host] = append(d[host], addr)
+	}
+	return nil
+}
+
+func (d dnsOverrides) lookupHost(host string) ([]string, error) {
+	addrs, ok := d[host]
+	if !ok {
+		return net.LookupHost(host)
+	} else if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// pacCommand implements the "alpaca pac" subcommands, which are tools for debugging PAC
+// scripts. It returns the exit status for the process.
+func pacCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "test" {
+		return pacTestCommand(args[1:], stdin, stdout, stderr)
+	} else if len(args) > 0 && args[0] == "noproxy" {
+		return pacNoProxyCommand(args[1:], stdout, stderr)
+	}
+	fmt.Fprintln(stderr, "usage: alpaca pac test [flags] [url...]")
+	fmt.Fprintln(stderr, "       alpaca pac noproxy [flags] [host...]")
+	return 2
+}
+
+// pacFlags are the flags used by the "alpaca pac" subcommands to load the PAC script, and to
+// control what the PAC script sees when it runs.
+type pacFlags struct {
+	pacurl, pacfile, myip, now, engineName *string
+	ipv6                                   *bool
+	dns                                    dnsOverrides
+}
+
+func addPACFlags(fs *flag.FlagSet) *pacFlags {
+	f := &pacFlags{dns: dnsOverrides{}}
+	f.pacurl = fs.String("C", "", "url of proxy auto-config (pac) file")
+	f.pacfile = fs.String("f", "", "path to a local proxy auto-config (pac) file")
+	f.myip = fs.String("myip", "", "address to be returned by myIpAddress()")
+	f.now = fs.String("time", "", "current time seen by the PAC script (RFC 3339 format)")
+	f.ipv6 = fs.Bool("ipv6", false, "support IPv6 addresses in isInNet, dnsResolve and myIpAddress")
+	f.engineName = fs.String("pac-engine", defaultPACEngine, "JavaScript engine used to run the pac file ("+pacEngineNames()+")")
+	fs.Var(f.dns, "dns", "DNS answer to use for a host, as host=addr[,addr...] (repeatable)")
+	return f
+}
+
+// load loads the PAC script into a new PACRunner. If it fails, it returns the exit status for
+// the process.
+func (f *pacFlags) load(stderr io.Writer) (*PACRunner, []byte, int) {
+	engine, err := lookupPACEngine(*f.engineName)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid -pac-engine: %v\n", err)
+		return nil, nil, 2
+	}
+	pr := &PACRunner{engine: engine, ipv6: *f.ipv6}
+	if *f.myip != "" {
+		if net.ParseIP(*f.myip) == nil {
+			fmt.Fprintf(stderr, "Invalid IP address for -myip: %q\n", *f.myip)
+			return nil, nil, 2
+		}
+		myip := *f.myip
+		pr.myIPAddress = func() string { return myip }
+	}
+	if *f.now != "" {
+		t, err := time.Parse(time.RFC3339, *f.now)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid time for -time: %v\n", err)
+			return nil, nil, 2
+		}
+		pr.now = func() time.Time { return t }
+	}
+	if len(f.dns) > 0 {
+		pr.lookupHost = f.dns.lookupHost
+	}
+
+	pacjs, err := loadPAC(*f.pacurl, *f.pacfile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error loading PAC script: %v\n", err)
+		return nil, nil, 1
+	}
+	if err := pr.Update(pacjs); err != nil {
+		fmt.Fprintf(stderr, "Error running PAC script: %v\n", err)
+		return nil, nil, 1
+	}
+	return pr, pacjs, 0
+}
+
+func pacTestCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("alpaca pac test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: alpaca pac test [flags] [url...]")
+		fmt.Fprintln(stderr, "Evaluates the PAC script for each URL (read from stdin if none are given).")
+		fs.PrintDefaults()
+	}
+	pf := addPACFlags(fs)
+	trace := fs.Bool("trace", false, "print the helper function calls made by the PAC script")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	pr, _, status := pf.load(stderr)
+	if pr == nil {
+		return status
+	}
+
+	urls := fs.Args()
+	if len(urls) == 0 {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				urls = append(urls, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(stderr, "Error reading URLs from stdin: %v\n", err)
+			return 1
+		}
+	}
+
+	for _, rawurl := range urls {
+		if err := testURL(pr, rawurl, *trace, stdout); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", rawurl, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func pacNoProxyCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("alpaca pac noproxy", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: alpaca pac noproxy [flags] [host...]")
+		fmt.Fprintln(stderr, "Prints a NO_PROXY value for the hosts that the PAC script sends directly, based on")
+		fmt.Fprintln(stderr, "its rules and on the given hosts. Rules that can't be translated are listed on stderr.")
+		fs.PrintDefaults()
+	}
+	pf := addPACFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	pr, pacjs, status := pf.load(stderr)
+	if pr == nil {
+		return status
+	}
+	candidates := append([]string{"localhost", "127.0.0.1"}, fs.Args()...)
+	entries, flagged, err := generateNoProxy(pr, pacjs, candidates)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error analysing PAC script: %v\n", err)
+		return 1
+	}
+	for _, rule := range flagged {
+		if len(rule.entries) == 0 {
+			fmt.Fprintf(stderr, "Couldn't translate %s\n", rule)
+		} else {
+			fmt.Fprintf(stderr, "Warning for %s\n", rule)
+		}
+	}
+	fmt.Fprintln(stdout, strings.Join(entries, ","))
+	return 0
+}
+
+// loadPAC reads a PAC script from a local file if one is given, or otherwise downloads it
+// from the given URL (or the URL from the system settings, if pacurl is empty).
+func loadPAC(pacurl, pacfile string) ([]byte, error) {
+	if pacfile != "" {
+		return os.ReadFile(pacfile)
+	}
+	if pacurl == "" {
+		detected, err := newPacFinder("").findPACURL()
+		if err != nil {
+			return nil, fmt.Errorf("error detecting PAC URL: %w", err)
+		} else if detected == "" {
+			return nil, errors.New("no PAC URL specified (using -C or -f) or detected")
+		}
+		pacurl = detected
+	}
+	return newPACFetcher(pacurl).fetch(pacurl)
+}
+
+func testURL(pr *PACRunner, rawurl string, trace bool, w io.Writer) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	} else if u.Host == "" {
+		return errors.New("URL must be absolute (e.g. https://www.example.com/)")
+	}
+	var result string
+	var t *PACTrace
+	if trace {
+		t = pr.Trace(*u)
+		result, err = t.Result, t.Err
+	} else {
+		result, err = pr.FindProxyForURL(*u)
+	}
+	if err != nil {
+		if t != nil {
+			fmt.Fprint(w, t)
+		}
+		return err
+	}
+	entries, invalid := parseProxyList(result)
+	proxies := make([]string, len(entries))
+	for i, entry := range entries {
+		proxies[i] = entry.String()
+	}
+	fmt.Fprintf(w, "URL:     %s\n", u)
+	fmt.Fprintf(w, "Result:  %q\n", result)
+	fmt.Fprintf(w, "Proxies: %s\n", strings.Join(proxies, ", "))
+	for _, elem := range invalid {
+		fmt.Fprintf(w, "Invalid: %q\n", strings.TrimSpace(elem))
+	}
+	if t != nil {
+		fmt.Fprint(w, t)
+	}
+	return nil
+}
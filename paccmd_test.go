@@ -0,0 +1,140 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPACForCommand = `function FindProxyForURL(url, host) {
+  if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0"))
+    return "DIRECT";
+  if (myIpAddress() == "192.0.2.1")
+    return "PROXY home.test:8080";
+  if (dateRange(2020))
+    return "SOCKS socks.test:1080; HTTPS old.test";
+  return "PROXY proxy.test:3128; DIRECT";
+}`
+
+func runPACTest(t *testing.T, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := pacCommand(append([]string{"test"}, args...), strings.NewReader(stdin),
+		&stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestPACTestCommand(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(testPACForCommand)))
+	defer server.Close()
+	status, stdout, stderr := runPACTest(t, "", "-C", server.URL,
+		"-dns", "internal.test=10.1.2.3", "-dns", "external.test=192.0.2.2",
+		"http://internal.test/a", "https://external.test/b?c=d")
+	require.Equal(t, 0, status, stderr)
+	assert.Equal(t, `URL:     http://internal.test/a
+Result:  "DIRECT"
+Proxies: DIRECT
+URL:     https://external.test/b?c=d
+Result:  "PROXY proxy.test:3128; DIRECT"
+Proxies: http://proxy.test:3128, DIRECT
+`, stdout)
+}
+
+func TestPACTestCommandOverrides(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, []byte(testPACForCommand), 0644))
+	dns := []string{"-dns", "www.test=192.0.2.3"}
+
+	args := append([]string{"-f", pacPath, "-myip", "192.0.2.1"}, dns...)
+	status, stdout, stderr := runPACTest(t, "http://www.test/\n", args...)
+	require.Equal(t, 0, status, stderr)
+	assert.Contains(t, stdout, `Result:  "PROXY home.test:8080"`)
+
+	args = append([]string{"-f", pacPath, "-time", "2020-06-01T12:00:00Z"}, dns...)
+	status, stdout, stderr = runPACTest(t, "http://www.test/\n", args...)
+	require.Equal(t, 0, status, stderr)
+	assert.Contains(t, stdout, "Proxies: https://old.test:443\n")
+	assert.Contains(t, stdout, `Invalid: "SOCKS socks.test:1080"`)
+}
+
+func TestPACTestCommandTrace(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, []byte(testPACForCommand), 0644))
+	status, stdout, stderr := runPACTest(t, "", "-f", pacPath, "-trace",
+		"-dns", "internal.test=10.1.2.3", "http://internal.test/")
+	require.Equal(t, 0, status, stderr)
+	assert.Equal(t, `URL:     http://internal.test/
+Result:  "DIRECT"
+Proxies: DIRECT
+dnsResolve("internal.test") = "10.1.2.3"
+isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0") = true
+FindProxyForURL("http://internal.test/", "internal.test") = "DIRECT"
+`, stdout)
+}
+
+func TestPACTestCommandEngine(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	pacjs := "const FindProxyForURL = (url, host) => `PROXY ${host}:3128`;"
+	require.NoError(t, os.WriteFile(pacPath, []byte(pacjs), 0644))
+	status, stdout, stderr := runPACTest(t, "", "-f", pacPath, "-pac-engine", "goja",
+		"http://www.test/")
+	require.Equal(t, 0, status, stderr)
+	assert.Contains(t, stdout, `Result:  "PROXY www.test:3128"`)
+}
+
+func TestPACTestCommandErrors(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, []byte("throw 'error'"), 0644))
+	status, _, _ := runPACTest(t, "", "-f", pacPath, "http://www.test/")
+	assert.Equal(t, 1, status)
+	status, _, _ = runPACTest(t, "", "-f", pacPath, "-dns", "nonsense", "http://www.test/")
+	assert.Equal(t, 2, status)
+	status, _, _ = runPACTest(t, "", "-f", filepath.Join(t.TempDir(), "nonexistent.pac"))
+	assert.Equal(t, 1, status)
+	status, _, _ = runPACTest(t, "", "-f", pacPath, "-pac-engine", "v8", "http://www.test/")
+	assert.Equal(t, 2, status)
+}
+
+func TestPACNoProxyCommand(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	pacjs := `function FindProxyForURL(url, host) {
+  if (isPlainHostName(host) || dnsDomainIs(host, ".internal.test")) return "DIRECT";
+  if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) return "DIRECT";
+  return "PROXY proxy.test:3128";
+}`
+	require.NoError(t, os.WriteFile(pacPath, []byte(pacjs), 0644))
+	var stdout, stderr bytes.Buffer
+	status := pacCommand([]string{"noproxy", "-f", pacPath,
+		"-dns", "noproxy-check.internal.test=", "-dns", "wiki.test=10.1.2.3",
+		"-dns", "www.test=192.0.2.1", "wiki.test", "www.test"},
+		strings.NewReader(""), &stdout, &stderr)
+	require.Equal(t, 0, status, stderr.String())
+	// The rule for 10.0.0.0/8 only covers hosts given as IP addresses, so wiki.test is there
+	// too. Plain host names (like localhost) have to be listed separately.
+	assert.Equal(t, ".internal.test,10.0.0.0/8,localhost,wiki.test\n", stdout.String())
+	assert.Equal(t, "Couldn't translate line 2: isPlainHostName(host): "+
+		"NO_PROXY can't match plain host names (without a domain)\n"+
+		`Warning for line 3: isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0"): `+
+		"NO_PROXY only matches IP literals; host names resolving into 10.0.0.0/8 still go via the proxy\n",
+		stderr.String())
+}
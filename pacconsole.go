@@ -0,0 +1,85 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// A PAC script may write a message for every request, so messages are rate limited using a
+// token bucket: up to pacConsoleBurst messages can be logged at once, after which messages are
+// logged at pacConsoleRate per second, and any others are dropped.
+const (
+	pacConsoleBurst = 20
+	pacConsoleRate  = 1.0
+)
+
+// pacConsole implements the alert() and console.log() functions for PAC scripts, by writing
+// messages to alpaca's log.
+type pacConsole struct {
+	tokens     float64
+	last       time.Time
+	suppressed int
+	now        func() time.Time
+	logf       func(format string, v ...interface{})
+	mux        sync.Mutex
+}
+
+func newPACConsole() *pacConsole {
+	return &pacConsole{tokens: pacConsoleBurst, now: time.Now, logf: log.Printf}
+}
+
+func (c *pacConsole) write(source, msg string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	now := c.now()
+	refill := now.Sub(c.last).Seconds() * pacConsoleRate
+	c.tokens = math.Min(pacConsoleBurst, c.tokens+refill)
+	c.last = now
+	if c.tokens < 1 {
+		c.suppressed++
+		return
+	}
+	c.tokens--
+	if c.suppressed > 0 {
+		c.logf("PAC script is logging too much, suppressed %d messages", c.suppressed)
+		c.suppressed = 0
+	}
+	c.logf("PAC %s: %s", source, msg)
+}
+
+func (c *pacConsole) alert(call otto.FunctionCall) otto.Value {
+	c.write("alert", call.Argument(0).String())
+	return otto.UndefinedValue()
+}
+
+// print returns an implementation of console.log() (or console.warn(), etc), which logs its
+// arguments separated by spaces.
+func (c *pacConsole) print(source string) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		args := make([]string, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i] = arg.String()
+		}
+		c.write(source, strings.Join(args, " "))
+		return otto.UndefinedValue()
+	}
+}
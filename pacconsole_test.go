@@ -0,0 +1,80 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLog struct {
+	lines []string
+}
+
+func (l *fakeLog) logf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestAlertAndConsole(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		var l fakeLog
+		pr := PACRunner{engine: engine, console: newPACConsole()}
+		pr.console.logf = l.logf
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			alert("checking " + host);
+			console.log("url is", url, 42);
+			console.warn("going direct");
+			return "DIRECT";
+		}`)
+		require.NoError(t, pr.Update(pacjs))
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "DIRECT", proxy)
+		assert.Equal(t, []string{
+			"PAC alert: checking www.test",
+			"PAC console.log: url is http://www.test 42",
+			"PAC console.warn: going direct",
+		}, l.lines)
+	})
+}
+
+func TestConsoleRateLimit(t *testing.T) {
+	var l fakeLog
+	var now time.Time
+	c := newPACConsole()
+	c.logf = l.logf
+	c.now = func() time.Time { return now }
+	for i := 0; i < pacConsoleBurst+5; i++ {
+		c.write("alert", "hello")
+	}
+	assert.Len(t, l.lines, pacConsoleBurst)
+	// After a couple of seconds, two more messages can be logged, and the first of them is
+	// preceded by a note about the messages that were dropped.
+	now = now.Add(2 * time.Second)
+	l.lines = nil
+	for i := 0; i < 3; i++ {
+		c.write("alert", "world")
+	}
+	assert.Equal(t, []string{
+		"PAC script is logging too much, suppressed 5 messages",
+		"PAC alert: world",
+		"PAC alert: world",
+	}, l.lines)
+}
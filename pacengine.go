@@ -0,0 +1,78 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+)
+
+// pacFunc is a PAC helper function (dnsResolve, isInNet, etc). The helpers are written using
+// otto's types, and engines other than otto convert the arguments and results.
+type pacFunc = func(otto.FunctionCall) otto.Value
+
+// pacEngine is a JavaScript engine that can run PAC scripts.
+type pacEngine interface {
+	// compile parses a PAC script, so that it can then be run in any number of VMs.
+	compile(src []byte) (pacScript, error)
+	newVM() pacEngineVM
+}
+
+// pacScript is a compiled script. Its type depends on the engine that compiled it.
+type pacScript interface{}
+
+// pacEngineVM is a single JavaScript VM, which can only be used by one goroutine at a time.
+type pacEngineVM interface {
+	// set defines a global function.
+	set(name string, fn pacFunc) error
+	// setObject defines a global object with the given methods (e.g. console.log).
+	setObject(name string, methods map[string]pacFunc) error
+	run(script pacScript) error
+	isFunction(name string) bool
+	// call calls a global function, and returns its result converted to a Go value.
+	call(name string, args ...string) (interface{}, error)
+	// interrupt stops the script that's currently running, which makes run or call return
+	// errPACTimeout. It can be called from another goroutine. If no script is running, the
+	// next one will be stopped, unless clearInterrupt is called first.
+	interrupt()
+	clearInterrupt()
+}
+
+var pacEngines = map[string]pacEngine{
+	"otto": ottoEngine{},
+	"goja": gojaEngine{},
+}
+
+const defaultPACEngine = "otto"
+
+func pacEngineNames() string {
+	names := make([]string, 0, len(pacEngines))
+	for name := range pacEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func lookupPACEngine(name string) (pacEngine, error) {
+	engine, ok := pacEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown JavaScript engine %q (must be one of %s)", name, pacEngineNames())
+	}
+	return engine, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dop251/goja"
+	"github.com/robertkrimen/otto"
+)
+
+// gojaEngine runs PAC scripts using goja, which supports ES2015 and later (let, arrow
+// functions, template literals, etc), and is generally faster than otto.
+type gojaEngine struct{}
+
+func (gojaEngine) compile(src []byte) (pacScript, error) {
+	return goja.Compile("", string(src), false)
+}
+
+func (gojaEngine) newVM() pacEngineVM {
+	return gojaVM{goja.New()}
+}
+
+type gojaVM struct {
+	vm *goja.Runtime
+}
+
+// wrap converts a helper function to a goja function, by converting its arguments to otto
+// values and its result back to a goja value. The helpers only take and return primitive
+// values, so this doesn't need to handle objects.
+func (v gojaVM) wrap(fn pacFunc) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		args := make([]otto.Value, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = fromGoja(arg)
+		}
+		return toGoja(v.vm, fn(otto.FunctionCall{ArgumentList: args}))
+	}
+}
+
+func fromGoja(val goja.Value) otto.Value {
+	if goja.IsUndefined(val) {
+		return otto.UndefinedValue()
+	} else if goja.IsNull(val) {
+		return otto.NullValue()
+	}
+	switch exported := val.Export().(type) {
+	case string, bool, int64, float64:
+		return toValue(exported)
+	default:
+		return toValue(val.String())
+	}
+}
+
+func toGoja(vm *goja.Runtime, val otto.Value) goja.Value {
+	if val.IsNull() {
+		return goja.Null()
+	}
+	exported, err := val.Export()
+	if err != nil || exported == nil {
+		return goja.Undefined()
+	}
+	return vm.ToValue(exported)
+}
+
+func (v gojaVM) set(name string, fn pacFunc) error {
+	return v.vm.Set(name, v.wrap(fn))
+}
+
+func (v gojaVM) setObject(name string, methods map[string]pacFunc) error {
+	obj := v.vm.NewObject()
+	for method, fn := range methods {
+		if err := obj.Set(method, v.wrap(fn)); err != nil {
+			return err
+		}
+	}
+	return v.vm.Set(name, obj)
+}
+
+func (v gojaVM) run(script pacScript) error {
+	_, err := v.vm.RunProgram(script.(*goja.Program))
+	return fromGojaError(err)
+}
+
+func (v gojaVM) isFunction(name string) bool {
+	_, ok := goja.AssertFunction(v.vm.Get(name))
+	return ok
+}
+
+func (v gojaVM) call(name string, args ...string) (interface{}, error) {
+	fn, ok := goja.AssertFunction(v.vm.Get(name))
+	if !ok {
+		return nil, fmt.Errorf("%s is not a function", name)
+	}
+	argv := make([]goja.Value, len(args))
+	for i, arg := range args {
+		argv[i] = v.vm.ToValue(arg)
+	}
+	val, err := fn(goja.Undefined(), argv...)
+	if err != nil {
+		return nil, fromGojaError(err)
+	}
+	return val.Export(), nil
+}
+
+// fromGojaError converts the error that goja returns after an interrupt to errPACTimeout.
+func fromGojaError(err error) error {
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) && interrupted.Value() == errPACTimeout {
+		return errPACTimeout
+	}
+	return err
+}
+
+func (v gojaVM) interrupt() {
+	v.vm.Interrupt(errPACTimeout)
+}
+
+func (v gojaVM) clearInterrupt() {
+	v.vm.ClearInterrupt()
+}
@@ -0,0 +1,102 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/robertkrimen/otto"
+)
+
+// ottoEngine runs PAC scripts using otto, which only supports ES5.
+type ottoEngine struct{}
+
+func (ottoEngine) compile(src []byte) (pacScript, error) {
+	return otto.New().Compile("", src)
+}
+
+func (ottoEngine) newVM() pacEngineVM {
+	vm := otto.New()
+	// The buffer allows interrupt to be called without blocking.
+	vm.Interrupt = make(chan func(), 1)
+	return ottoVM{vm}
+}
+
+type ottoVM struct {
+	vm *otto.Otto
+}
+
+func (v ottoVM) set(name string, fn pacFunc) error {
+	return v.vm.Set(name, fn)
+}
+
+func (v ottoVM) setObject(name string, methods map[string]pacFunc) error {
+	obj, err := v.vm.Object(name + " = {}")
+	if err != nil {
+		return err
+	}
+	for method, fn := range methods {
+		if err := obj.Set(method, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v ottoVM) run(script pacScript) (err error) {
+	defer recoverInterrupt(&err)
+	_, err = v.vm.Run(script.(*otto.Script))
+	return err
+}
+
+func (v ottoVM) isFunction(name string) bool {
+	fn, err := v.vm.Get(name)
+	return err == nil && fn.IsFunction()
+}
+
+func (v ottoVM) call(name string, args ...string) (result interface{}, err error) {
+	defer recoverInterrupt(&err)
+	argv := make([]interface{}, len(args))
+	for i, arg := range args {
+		argv[i] = arg
+	}
+	val, err := v.vm.Call(name, nil, argv...)
+	if err != nil {
+		return nil, err
+	}
+	return val.Export()
+}
+
+// otto stops a script by calling the function sent on its Interrupt channel, which panics
+// with errPACTimeout. The panic propagates out of Run or Call, and is recovered here.
+func recoverInterrupt(err *error) {
+	if r := recover(); r == errPACTimeout {
+		*err = errPACTimeout
+	} else if r != nil {
+		panic(r)
+	}
+}
+
+func (v ottoVM) interrupt() {
+	select {
+	case v.vm.Interrupt <- func() { panic(errPACTimeout) }:
+	default: // There's already an interrupt waiting.
+	}
+}
+
+func (v ottoVM) clearInterrupt() {
+	select {
+	case <-v.vm.Interrupt:
+	default:
+	}
+}
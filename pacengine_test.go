@@ -0,0 +1,92 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forEachEngine runs a test as a subtest for each of the JavaScript engines.
+func forEachEngine(t *testing.T, test func(t *testing.T, engine pacEngine)) {
+	names := make([]string, 0, len(pacEngines))
+	for name := range pacEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) { test(t, pacEngines[name]) })
+	}
+}
+
+func TestLookupPACEngine(t *testing.T) {
+	engine, err := lookupPACEngine("goja")
+	require.NoError(t, err)
+	assert.Equal(t, gojaEngine{}, engine)
+	_, err = lookupPACEngine("v8")
+	assert.EqualError(t, err, `unknown JavaScript engine "v8" (must be one of goja, otto)`)
+}
+
+func TestModernJavaScript(t *testing.T) {
+	pacjs := []byte(`const internal = ["corp.test", "intranet.test"];
+	let FindProxyForURL = (url, host) =>
+		internal.some((domain) => dnsDomainIs(host, domain)) ? "DIRECT" : ` + "`PROXY ${host.length}.test:80`;")
+	var pr PACRunner
+	assert.Error(t, pr.Update(pacjs), "otto doesn't support ES2015")
+	pr = PACRunner{engine: gojaEngine{}}
+	require.NoError(t, pr.Update(pacjs))
+	proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.corp.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+	proxy, err = pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY 8.test:80", proxy)
+}
+
+// TestHelperArguments checks that values are passed between each engine and the helper
+// functions without being mangled.
+func TestHelperArguments(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{
+			engine: engine,
+			now: func() time.Time {
+				return time.Date(2019, 7, 1, 11, 0, 0, 0, time.UTC)
+			},
+			lookupHost: func(host string) ([]string, error) { return []string{"10.1.2.3"}, nil },
+		}
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			return [
+				isPlainHostName(host),
+				dnsResolve(host),
+				convert_addr("10.0.0.1"),
+				dnsDomainLevels(host),
+				dateRange(1, "JUL", 2019, "GMT"),
+				timeRange(10, 12, "GMT"),
+				isInNet(host, "10.0.0.0", "255.0.0.0"),
+				sortIpAddressList(),
+				typeof alert("hello"),
+			].join(" ");
+		}`)
+		require.NoError(t, pr.Update(pacjs))
+		result, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "false 10.1.2.3 167772161 1 true true true false undefined", result)
+	})
+}
@@ -20,8 +20,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"runtime"
-	"strings"
+	"slices"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,10 +36,26 @@ const maxResponseBytes = 1 * 1024 * 1024
 var delayAfterFailedDownload = 2 * time.Second
 
 type pacFetcher struct {
-	pacFinder  *pacFinder
-	monitor    netMonitor
-	client     *http.Client
-	connected  bool
+	pacFinder *pacFinder
+	// URLs to try (in order) if the PAC script can't be downloaded from the URL returned by
+	// the pacFinder. These are usually other servers that publish the same PAC script.
+	alternatives []string
+	// The URL that the PAC script was last downloaded from. This is tried first next time.
+	lastURL   string
+	monitor   netMonitor
+	client    *http.Client
+	connected bool
+	// If non-nil, this is called whenever the network monitor reports a change.
+	netChanged func()
+	// When the PAC script is loaded from a local file, we're considered to be online if this
+	// URL can be reached directly. If it's empty, we're always online.
+	checkURL string
+	// Watches the local PAC file (if any) for changes, and sets fileChanged when it's
+	// modified. If onFileChange is non-nil, it's also called.
+	watcher      *fileWatcher
+	fileChanged  atomic.Bool
+	onFileChange func()
+	warnedLocal  bool
 	//cache  []byte
 	//modified time.Time
 	//fetched time.Time
@@ -44,29 +63,32 @@ type pacFetcher struct {
 	//etag     string
 }
 
-func newPACFetcher(pacurl string) *pacFetcher {
-	client := &http.Client{Timeout: 30 * time.Second}
-	if strings.HasPrefix(pacurl, "file:") {
-		log.Print("Warning: When using a local PAC file, the online/offline status can't ",
-			"be determined by the fact that the PAC file is downloaded. Make sure you ",
-			"check for proxy connectivity in your PAC file!")
-		if runtime.GOOS == "windows" {
-			client.Transport = http.NewFileTransport(http.Dir("C:"))
-		} else {
-			client.Transport = http.NewFileTransport(http.Dir("/"))
-		}
+// newPACFetcher returns a pacFetcher that downloads the PAC script from the first of the given
+// URLs that works. If no URLs are given, the URL is detected from the system settings.
+func newPACFetcher(pacurls ...string) *pacFetcher {
+	// The DefaultClient in net/http uses the proxy specified in the http(s)_proxy
+	// environment variable, which could be pointing at this instance of alpaca. When
+	// fetching the PAC file, we always use a client that goes directly to the server,
+	// rather than via a proxy.
+	transport := &http.Transport{Proxy: nil}
+	if runtime.GOOS == "windows" {
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("C:")))
 	} else {
-		// The DefaultClient in net/http uses the proxy specified in the http(s)_proxy
-		// environment variable, which could be pointing at this instance of alpaca. When
-		// fetching the PAC file, we always use a client that goes directly to the server,
-		// rather than via a proxy.
-		client.Transport = &http.Transport{Proxy: nil}
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+	var pacurl string
+	if len(pacurls) > 0 {
+		pacurl = pacurls[0]
+	}
+	pf := &pacFetcher{
+		pacFinder: newPacFinder(pacurl),
+		monitor:   newNetMonitor(),
+		client:    &http.Client{Timeout: 30 * time.Second, Transport: transport},
 	}
-	return &pacFetcher{
-		pacFinder:  newPacFinder(pacurl),
-		monitor:    newNetMonitor(),
-		client:     client,
+	if len(pacurls) > 1 {
+		pf.alternatives = pacurls[1:]
 	}
+	return pf
 }
 
 func requireOK(resp *http.Response, err error) (*http.Response, error) {
@@ -81,7 +103,12 @@ func requireOK(resp *http.Response, err error) (*http.Response, error) {
 }
 
 func (pf *pacFetcher) download() []byte {
-	if !pf.monitor.addrsChanged() && !pf.pacFinder.pacChanged() {
+	addrsChanged := pf.monitor.addrsChanged()
+	if addrsChanged && pf.netChanged != nil {
+		pf.netChanged()
+	}
+	fileChanged := pf.fileChanged.Swap(false)
+	if !addrsChanged && !pf.pacFinder.pacChanged() && !fileChanged {
 		return nil
 	}
 	pf.connected = false
@@ -95,7 +122,100 @@ func (pf *pacFetcher) download() []byte {
 		return nil
 	}
 
-	log.Printf("Attempting to download PAC from %s", pacurl)
+	for _, pacurl := range pf.candidates(pacurl) {
+		log.Printf("Attempting to download PAC from %s", pacurl)
+		pacjs, err := pf.fetch(pacurl)
+		if err != nil {
+			log.Printf("Error downloading PAC file from %s: %q", pacurl, err)
+			continue
+		}
+		pf.lastURL = pacurl
+		path, local := localPath(pacurl)
+		pf.watch(path)
+		if local && !pf.checkReachable() {
+			return nil
+		}
+		pf.connected = true
+		return pacjs
+	}
+	log.Println("Couldn't download PAC file, giving up")
+	return nil
+}
+
+// localPath returns the path to the file that a file: URL refers to.
+func localPath(pacurl string) (string, bool) {
+	u, err := url.Parse(pacurl)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	// This matches the root directory used by the client's file transport.
+	if runtime.GOOS == "windows" {
+		return filepath.Join("C:", filepath.FromSlash(u.Path)), true
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// watch starts watching the given local PAC file for changes (and stops watching the previous
+// one). If path is empty, no file is watched.
+func (pf *pacFetcher) watch(path string) {
+	if pf.watcher != nil && pf.watcher.path == path {
+		return
+	} else if pf.watcher != nil {
+		pf.watcher.close()
+		pf.watcher = nil
+	}
+	if path == "" {
+		return
+	}
+	pf.watcher = newFileWatcher(path, func() {
+		log.Printf("PAC file %s has changed", path)
+		pf.fileChanged.Store(true)
+		if pf.onFileChange != nil {
+			pf.onFileChange()
+		}
+	})
+}
+
+// checkReachable is used to decide whether we're online when the PAC script is loaded from a
+// local file, since the fact that we can read the file doesn't tell us anything about the
+// network. Any response to a request for checkURL (made directly, not via a proxy) counts.
+func (pf *pacFetcher) checkReachable() bool {
+	if pf.checkURL == "" {
+		if !pf.warnedLocal {
+			log.Print("Warning: When using a local PAC file, the online/offline status ",
+				"can't be determined by the fact that the PAC file is downloaded. Make ",
+				"sure you check for proxy connectivity in your PAC file, or use ",
+				"-pac-check-url!")
+			pf.warnedLocal = true
+		}
+		return true
+	}
+	resp, err := pf.client.Get(pf.checkURL)
+	if err != nil {
+		log.Printf("Can't reach %s, so requests will be made directly: %v", pf.checkURL, err)
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// candidates returns the URLs to try downloading the PAC script from, in order: the URL that
+// last worked (if it's still one of the options), then the given URL, then the alternatives.
+func (pf *pacFetcher) candidates(pacurl string) []string {
+	urls := []string{pacurl}
+	for _, u := range pf.alternatives {
+		if !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	if i := slices.Index(urls, pf.lastURL); i > 0 {
+		urls = slices.Insert(slices.Delete(urls, i, i+1), 0, pf.lastURL)
+	}
+	return urls
+}
+
+// fetch downloads the PAC script from the given URL, retrying once if the first attempt fails.
+func (pf *pacFetcher) fetch(pacurl string) ([]byte, error) {
 	resp, err := requireOK(pf.client.Get(pacurl))
 	if err != nil {
 		// Sometimes, if we try to download too soon after a network change, the PAC
@@ -104,22 +224,18 @@ func (pf *pacFetcher) download() []byte {
 			delayAfterFailedDownload, err)
 		time.Sleep(delayAfterFailedDownload)
 		if resp, err = requireOK(pf.client.Get(pacurl)); err != nil {
-			log.Printf("Error downloading PAC file, giving up: %q", err)
-			return nil
+			return nil, err
 		}
 	}
 	defer resp.Body.Close()
 	var buf bytes.Buffer
 	_, err = io.CopyN(&buf, resp.Body, maxResponseBytes)
 	if err == io.EOF {
-		pf.connected = true
-		return buf.Bytes()
+		return buf.Bytes(), nil
 	} else if err != nil {
-		log.Printf("Error reading PAC JS from response body: %q", err)
-		return nil
+		return nil, fmt.Errorf("error reading PAC JS from response body: %w", err)
 	} else {
-		log.Printf("PAC JS is too big (limit is %d bytes)", maxResponseBytes)
-		return nil
+		return nil, fmt.Errorf("PAC JS is too big (limit is %d bytes)", maxResponseBytes)
 	}
 }
 
@@ -106,6 +106,48 @@ func TestDownloadWithNetworkChanges(t *testing.T) {
 	assert.True(t, pf.isConnected())
 }
 
+func TestDownloadFromAlternativeURLs(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(pacjsHandler("primary script")))
+	secondary := httptest.NewServer(http.HandlerFunc(pacjsHandler("secondary script")))
+	defer secondary.Close()
+	nm := &fakeNetMonitor{true}
+	pf := newPACFetcher(primary.URL, "http://pacserver.invalid/proxy.pac", secondary.URL)
+	pf.monitor = nm
+	assert.Equal(t, []byte("primary script"), pf.download())
+	// When the primary server is down, the PAC script is downloaded from the first of the
+	// alternatives that works.
+	primary.Close()
+	nm.changed = true
+	assert.Equal(t, []byte("secondary script"), pf.download())
+	assert.True(t, pf.isConnected())
+	// The URL that worked last time is tried first.
+	assert.Equal(t, []string{
+		secondary.URL, primary.URL, "http://pacserver.invalid/proxy.pac",
+	}, pf.candidates(primary.URL))
+	// If none of them work, we're disconnected.
+	secondary.Close()
+	nm.changed = true
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+}
+
+func TestNetworkChangeCallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script")))
+	defer server.Close()
+	nm := &fakeNetMonitor{true}
+	pf := newPACFetcher(server.URL)
+	pf.monitor = nm
+	count := 0
+	pf.netChanged = func() { count++ }
+	pf.download()
+	assert.Equal(t, 1, count)
+	pf.download()
+	assert.Equal(t, 1, count)
+	nm.changed = true
+	pf.download()
+	assert.Equal(t, 2, count)
+}
+
 func TestResponseLimit(t *testing.T) {
 	bigscript := strings.Repeat("x", 2*1024*1024) // 2 MB
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(bigscript)))
@@ -129,3 +171,39 @@ func TestPacFromFilesystem(t *testing.T) {
 	assert.Equal(t, content, pf.download())
 	assert.True(t, pf.isConnected())
 }
+
+func TestReloadLocalPACFile(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, []byte("old script"), 0644))
+	pacURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(pacPath)}
+	pf := newPACFetcher(pacURL.String())
+	pf.monitor = &fakeNetMonitor{true}
+	changed := make(chan struct{}, 10)
+	pf.onFileChange = func() { changed <- struct{}{} }
+	assert.Equal(t, []byte("old script"), pf.download())
+	defer pf.watch("")
+	assert.Nil(t, pf.download())
+	require.NoError(t, os.WriteFile(pacPath, []byte("new script"), 0644))
+	waitForChange(t, changed)
+	assert.Equal(t, []byte("new script"), pf.download())
+	assert.True(t, pf.isConnected())
+}
+
+func TestLocalPACFileCheckURL(t *testing.T) {
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, []byte("test script"), 0644))
+	pacURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(pacPath)}
+	server := httptest.NewServer(http.NotFoundHandler())
+	nm := &fakeNetMonitor{true}
+	pf := newPACFetcher(pacURL.String())
+	defer pf.watch("")
+	pf.monitor = nm
+	pf.checkURL = server.URL
+	// Any response (even a 404) means that we're online.
+	assert.Equal(t, []byte("test script"), pf.download())
+	assert.True(t, pf.isConnected())
+	server.Close()
+	nm.changed = true
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+}
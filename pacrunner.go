@@ -15,15 +15,26 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"log"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
 	"github.com/gobwas/glob"
 	"github.com/robertkrimen/otto"
 )
@@ -31,52 +42,508 @@ import (
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_(PAC)_file
 
 type PACRunner struct {
-	vm *otto.Otto
-	sync.Mutex
+	// The pool of VMs that are ready to run the current PAC script. Update replaces this with
+	// a new pool, so that it's safe to call FindProxyForURL concurrently with Update.
+	pool atomic.Pointer[pacPool]
+	// The number of VMs in the pool. If zero, the pool has one VM per CPU (GOMAXPROCS).
+	poolSize int
+	// The JavaScript engine used to run the PAC script. If nil, otto is used.
+	engine pacEngine
+	// How long to cache the results of FindProxyForURL for. If zero, results aren't cached.
+	cacheTTL time.Duration
+	// The maximum time that the PAC script can run for, when it's loaded and for each call
+	// to FindProxyForURL. If zero, there is no limit.
+	timeout time.Duration
+	// If non-empty, FindProxyForURL returns this (e.g. "DIRECT") rather than an error when
+	// the PAC script fails or times out.
+	fallback string
+	// These functions can be set (before calling Update) to override the environment that
+	// the PAC script sees, which is useful when debugging a PAC script. If they are nil, the
+	// system clock, resolver and network interfaces are used.
+	now         func() time.Time
+	lookupHost  func(host string) ([]string, error)
+	myIPAddress func() string
+	// If non-nil, DNS lookups made by the PAC script (when lookupHost isn't set) go through
+	// this cache.
+	dns *dnsCache
+	// If true, isInNet, dnsResolve and myIpAddress handle IPv6 addresses (rather than only
+	// IPv4 addresses, as Chrome does).
+	ipv6 bool
+	// The implementation of alert() and console.log(), which is shared between updates so
+	// that rate limiting continues to work when a new PAC script is loaded.
+	console *pacConsole
+	// Before a new PAC script is used, it's evaluated for each of these URLs. If it fails for
+	// all of them, the new script is rejected, and the previous one is kept.
+	probeURLs []url.URL
+	// Serialises calls to Update.
+	mux sync.Mutex
+}
+
+// pacPool holds a set of VMs which have each been initialised with the helper functions and the
+// same PAC script. Each VM can only be used by one goroutine at a time, so having several of
+// them allows requests to be evaluated in parallel.
+type pacPool struct {
+	vms    chan *pacVM
+	script pacScript
+	// The function to call for each request. This is FindProxyForURLEx if the PAC script
+	// defines it (see Microsoft's IPv6 extensions to PAC), or FindProxyForURL otherwise.
+	entryPoint string
+	// Results from this pool's PAC script, or nil if results shouldn't be cached.
+	cache *resultCache
+	// Whether the entry point might use its url argument, rather than just the host. If not,
+	// results are cached by scheme, host and port, rather than by the whole URL.
+	usesURL bool
+}
+
+// If a PAC script refers to any of these functions, its results depend on the current time,
+// so they can't be cached.
+var timeDependent = regexp.MustCompile(`\b(timeRange|weekdayRange|dateRange|Date)\b`)
+
+// usesURL reports whether a PAC script's entry point refers to its url argument (which it could
+// do to look at the path, for example). If the script can't be analysed, it assumes so.
+func usesURL(pacjs []byte, entryPoint string) bool {
+	program, err := parser.ParseFile(nil, "", string(pacjs), 0)
+	if err != nil {
+		return true
+	}
+	fn := findEntryPoint(program.Body, entryPoint)
+	if fn == nil || fn.Body == nil {
+		return true
+	}
+	base := program.File.Base()
+	start, end := int(fn.Body.Idx0())-base, int(fn.Body.Idx1())-base
+	if start < 0 || end > len(pacjs) || start > end {
+		return true
+	}
+	names := []string{"arguments"}
+	if params := fn.ParameterList.List; len(params) > 0 {
+		id, ok := params[0].Target.(*ast.Identifier)
+		if !ok {
+			return true
+		}
+		names = append(names, id.Name.String())
+	}
+	// This also matches the name in strings and comments, which is fine (if unlikely).
+	for _, name := range names {
+		if regexp.MustCompile(`(^|[^\w$])` + regexp.QuoteMeta(name) + `($|[^\w$])`).Match(pacjs[start:end]) {
+			return true
+		}
+	}
+	return false
+}
+
+// errPACTimeout is used to interrupt a PAC script that has run for too long.
+var errPACTimeout = errors.New("PAC script took too long to run")
+
+type pacVM struct {
+	vm pacEngineVM
+	// If non-nil, calls to the helper functions are recorded here. This is only set for the
+	// duration of a call to Trace.
+	trace *PACTrace
+}
+
+// PACTrace is a record of a single evaluation of FindProxyForURL, including every call that
+// the PAC script made to the helper functions (dnsResolve, isInNet, etc).
+type PACTrace struct {
+	Function  string
+	URL, Host string
+	Calls     []PACCall
+	Result    string
+	Err       error
+}
+
+// PACCall is a single call to a helper function, with its arguments and result formatted as
+// JavaScript literals.
+type PACCall struct {
+	Function string
+	Args     []string
+	Result   string
+}
+
+func (c PACCall) String() string {
+	return fmt.Sprintf("%s(%s) = %s", c.Function, strings.Join(c.Args, ", "), c.Result)
+}
+
+func (t *PACTrace) String() string {
+	var sb strings.Builder
+	for _, call := range t.Calls {
+		fmt.Fprintln(&sb, call)
+	}
+	fmt.Fprintf(&sb, "%s(%q, %q) = ", t.Function, t.URL, t.Host)
+	if t.Err != nil {
+		fmt.Fprintf(&sb, "error: %v\n", t.Err)
+	} else {
+		fmt.Fprintf(&sb, "%q\n", t.Result)
+	}
+	return sb.String()
+}
+
+func formatValue(v otto.Value) string {
+	if v.IsString() {
+		return strconv.Quote(v.String())
+	}
+	return v.String()
 }
 
 func (pr *PACRunner) Update(pacjs []byte) error {
-	vm := otto.New()
+	pr.mux.Lock()
+	defer pr.mux.Unlock()
+	if pr.console == nil {
+		pr.console = newPACConsole()
+	}
+	if len(pacjs) > maxResponseBytes {
+		return fmt.Errorf("PAC script is too big (limit is %d bytes)", maxResponseBytes)
+	}
+	if pr.engine == nil {
+		pr.engine = pacEngines[defaultPACEngine]
+	}
+	// Parse the script once, and then run the compiled script in each VM.
+	script, err := pr.engine.compile(pacjs)
+	if err != nil {
+		return err
+	}
+	size := pr.poolSize
+	if size <= 0 {
+		size = runtime.GOMAXPROCS(0)
+	}
+	pool := &pacPool{
+		vms:        make(chan *pacVM, size),
+		script:     script,
+		entryPoint: "FindProxyForURL",
+	}
+	for i := 0; i < size; i++ {
+		v, err := pr.loadVM(script)
+		if err != nil {
+			return err
+		}
+		pool.vms <- v
+	}
+	v := <-pool.vms
+	if v.vm.isFunction("FindProxyForURLEx") {
+		pool.entryPoint = "FindProxyForURLEx"
+	}
+	pool.vms <- v
+	if err := pr.validate(pr.pool.Load(), pool); err != nil {
+		return err
+	}
+	if pr.cacheTTL > 0 && timeDependent.Match(pacjs) {
+		log.Printf("PAC script depends on the current time, so its results won't be cached")
+	} else if pr.cacheTTL > 0 {
+		pool.cache = newResultCache(pr.cacheTTL, maxCachedResults)
+		pool.usesURL = usesURL(pacjs, pool.entryPoint)
+	}
+	pr.pool.Store(pool)
+	return nil
+}
+
+// clone returns a new PACRunner with the same settings as this one, for running a different PAC
+// script (such as the PAC file that alpaca serves). It only has one VM, and doesn't cache
+// results or use the fallback.
+func (pr *PACRunner) clone() *PACRunner {
+	pr.mux.Lock()
+	defer pr.mux.Unlock()
+	return &PACRunner{
+		poolSize:    1,
+		engine:      pr.engine,
+		timeout:     pr.timeout,
+		now:         pr.now,
+		lookupHost:  pr.lookupHost,
+		myIPAddress: pr.myIPAddress,
+		dns:         pr.dns,
+		ipv6:        pr.ipv6,
+		console:     pr.console,
+	}
+}
+
+// validate checks that a newly loaded PAC script defines an entry point, and that it works for
+// at least one of the probe URLs. It also logs any probe URLs for which the new script gives a
+// different result to the old one, so that it's clear how the change affects requests.
+func (pr *PACRunner) validate(old, pool *pacPool) error {
+	v := <-pool.vms
+	defined := v.vm.isFunction(pool.entryPoint)
+	pool.vms <- v
+	if !defined {
+		return fmt.Errorf("PAC script doesn't define %s", pool.entryPoint)
+	}
+	var failures []string
+	for _, u := range pr.probeURLs {
+		u = pacURL(u)
+		result, err := pr.call(pool, u.String(), u.Hostname(), nil)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", u.String(), err))
+		}
+		if old == nil {
+			continue
+		}
+		oldResult, oldErr := pr.call(old, u.String(), u.Hostname(), nil)
+		before, after := describeResult(oldResult, oldErr), describeResult(result, err)
+		if before != after {
+			log.Printf("New PAC script changes the result for %s from %s to %s",
+				u.String(), before, after)
+		}
+	}
+	if len(failures) > 0 && len(failures) == len(pr.probeURLs) {
+		return fmt.Errorf("PAC script failed for every probe URL (%s)", strings.Join(failures, "; "))
+	}
+	for _, failure := range failures {
+		log.Printf("New PAC script failed for probe URL %s", failure)
+	}
+	return nil
+}
+
+func describeResult(result string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("error (%v)", err)
+	}
+	return strconv.Quote(result)
+}
+
+// loaded returns true if a PAC script has been successfully loaded.
+func (pr *PACRunner) loaded() bool {
+	return pr.pool.Load() != nil
+}
+
+// loadVM creates a VM and runs the PAC script in it, so that it's ready to be used by
+// FindProxyForURL.
+func (pr *PACRunner) loadVM(script pacScript) (*pacVM, error) {
+	v, err := pr.newVM()
+	if err != nil {
+		return nil, err
+	}
+	err = v.run(pr.timeout, func() error { return v.vm.run(script) })
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// newVM creates a VM with all of the PAC helper functions defined.
+func (pr *PACRunner) newVM() (*pacVM, error) {
+	v := &pacVM{vm: pr.engine.newVM()}
+	now := pr.now
+	if now == nil {
+		now = time.Now
+	}
+	lookupHost := pr.lookupHost
+	if lookupHost == nil && pr.dns != nil {
+		lookupHost = pr.dns.lookupHost
+	} else if lookupHost == nil {
+		lookupHost = net.LookupHost
+	}
+	traced := func(name string, handler pacFunc) pacFunc {
+		return func(call otto.FunctionCall) otto.Value {
+			result := handler(call)
+			if v.trace != nil {
+				args := make([]string, len(call.ArgumentList))
+				for i, arg := range call.ArgumentList {
+					args[i] = formatValue(arg)
+				}
+				v.trace.Calls = append(v.trace.Calls, PACCall{name, args, formatValue(result)})
+			}
+			return result
+		}
+	}
 	var err error
-	set := func(name string, handler func(otto.FunctionCall) otto.Value) {
+	set := func(name string, handler pacFunc) {
 		if err != nil {
 			return
 		}
-		err = vm.Set(name, handler)
+		err = v.vm.set(name, traced(name, handler))
 	}
 	set("isPlainHostName", isPlainHostName)
 	set("dnsDomainIs", dnsDomainIs)
 	set("localHostOrDomainIs", localHostOrDomainIs)
-	set("isResolvable", isResolvable)
-	set("isInNet", isInNet)
-	set("dnsResolve", dnsResolve)
+	set("isResolvable", func(fc otto.FunctionCall) otto.Value {
+		return isResolvable(fc, lookupHost)
+	})
+	if pr.ipv6 {
+		set("isInNet", func(fc otto.FunctionCall) otto.Value {
+			return isInNetDualStack(fc, lookupHost)
+		})
+		set("dnsResolve", func(fc otto.FunctionCall) otto.Value {
+			return dnsResolveDualStack(fc, lookupHost)
+		})
+	} else {
+		set("isInNet", func(fc otto.FunctionCall) otto.Value {
+			return isInNet(fc, lookupHost)
+		})
+		set("dnsResolve", func(fc otto.FunctionCall) otto.Value {
+			return dnsResolve(fc, lookupHost)
+		})
+	}
 	set("convert_addr", convertAddr)
-	set("myIpAddress", myIpAddress)
+	if pr.myIPAddress != nil {
+		set("myIpAddress", func(otto.FunctionCall) otto.Value {
+			return toValue(pr.myIPAddress())
+		})
+		set("myIpAddressEx", func(otto.FunctionCall) otto.Value {
+			return toValue(pr.myIPAddress())
+		})
+	} else {
+		myIPAddress := myIpAddress
+		if pr.ipv6 {
+			myIPAddress = myIpAddressDualStack
+		}
+		set("myIpAddress", func(fc otto.FunctionCall) otto.Value {
+			return myIPAddress(fc, lookupHost)
+		})
+		set("myIpAddressEx", func(fc otto.FunctionCall) otto.Value {
+			return myIpAddressEx(fc, lookupHost)
+		})
+	}
+	set("isResolvableEx", func(fc otto.FunctionCall) otto.Value {
+		return isResolvableEx(fc, lookupHost)
+	})
+	set("isInNetEx", isInNetEx)
+	set("dnsResolveEx", func(fc otto.FunctionCall) otto.Value {
+		return dnsResolveEx(fc, lookupHost)
+	})
+	set("sortIpAddressList", sortIpAddressList)
+	set("getClientVersion", getClientVersion)
 	set("dnsDomainLevels", dnsDomainLevels)
 	set("shExpMatch", shExpMatch)
 	set("weekdayRange", func(fc otto.FunctionCall) otto.Value {
-		return weekdayRange(fc, time.Now())
+		return weekdayRange(fc, now())
 	})
 	set("dateRange", func(fc otto.FunctionCall) otto.Value {
-		return dateRange(fc, time.Now())
+		return dateRange(fc, now())
 	})
 	set("timeRange", func(fc otto.FunctionCall) otto.Value {
-		return timeRange(fc, time.Now())
+		return timeRange(fc, now())
 	})
+	set("alert", pr.console.alert)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	console := map[string]pacFunc{}
+	for _, method := range []string{"log", "warn", "error"} {
+		name := "console." + method
+		console[method] = traced(name, pr.console.print(name))
+	}
+	if err := v.vm.setObject("console", console); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// run calls f (which should run some JavaScript in this VM), and interrupts it if it's still
+// running after the timeout. Note that this can't interrupt a helper function (like
+// dnsResolve) that's blocked in Go code, so the script will only be stopped once it returns.
+// There's no way to limit the memory used by a script, but the timeout also limits how much a
+// runaway script can allocate.
+func (v *pacVM) run(timeout time.Duration, f func() error) error {
+	if timeout <= 0 {
+		return f()
+	}
+	fired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		v.vm.interrupt()
+		close(fired)
+	})
+	err := f()
+	if !timer.Stop() {
+		// The timer has fired. If the script finished before seeing the interrupt, remove
+		// it so that it doesn't affect the next call.
+		<-fired
+		v.vm.clearInterrupt()
 	}
-	_, err = vm.Run(pacjs)
+	if errors.Is(err, errPACTimeout) {
+		err = fmt.Errorf("%w (limit is %v)", errPACTimeout, timeout)
+	}
+	return err
+}
+
+// networkChanged discards any cached DNS lookups and results, since they may be different on
+// the new network.
+func (pr *PACRunner) networkChanged() {
+	if pr.dns != nil {
+		pr.dns.flush()
+	}
+	if pool := pr.pool.Load(); pool != nil && pool.cache != nil {
+		pool.cache.flush()
+	}
+}
+
+func (pr *PACRunner) FindProxyForURL(u url.URL) (string, error) {
+	u = pacURL(u)
+	pool := pr.pool.Load()
+	if pool == nil || pool.cache == nil {
+		result, err := pr.call(pool, u.String(), u.Hostname(), nil)
+		if err != nil {
+			return pr.fallbackOnError(u, err)
+		}
+		return result, nil
+	}
+	// Unless the script looks at the URL, its result only depends on the host.
+	key := u.Scheme + "://" + u.Host
+	if pool.usesURL {
+		key = u.String()
+	}
+	if result, ok := pool.cache.get(key); ok {
+		return result, nil
+	}
+	result, err := pr.call(pool, u.String(), u.Hostname(), nil)
 	if err != nil {
+		return pr.fallbackOnError(u, err)
+	}
+	pool.cache.add(key, result)
+	return result, nil
+}
+
+func (pr *PACRunner) fallbackOnError(u url.URL, err error) (string, error) {
+	if pr.fallback == "" {
+		return "", err
+	}
+	log.Printf("Error running PAC script for %s, falling back to %q: %v", u.String(), pr.fallback, err)
+	return pr.fallback, nil
+}
+
+// Trace evaluates FindProxyForURL like FindProxyForURL does, but also records the calls that
+// the PAC script makes to the helper functions.
+func (pr *PACRunner) Trace(u url.URL) *PACTrace {
+	u = pacURL(u)
+	trace := &PACTrace{Function: "FindProxyForURL", URL: u.String(), Host: u.Hostname()}
+	trace.Result, trace.Err = pr.call(pr.pool.Load(), u.String(), u.Hostname(), trace)
+	return trace
+}
+
+func (pr *PACRunner) call(pool *pacPool, u, host string, trace *PACTrace) (string, error) {
+	if pool == nil {
+		return "", errors.New("no PAC script has been loaded")
+	}
+	v := <-pool.vms
+	v.trace = trace
+	if trace != nil {
+		trace.Function = pool.entryPoint
+	}
+	var val interface{}
+	err := v.run(pr.timeout, func() (err error) {
+		val, err = v.vm.call(pool.entryPoint, u, host)
 		return err
+	})
+	v.trace = nil
+	if errors.Is(err, errPACTimeout) {
+		// The script was stopped part way through, so the VM's global state could be
+		// inconsistent. Replace it with a freshly loaded VM if we can.
+		if replacement, err := pr.loadVM(pool.script); err != nil {
+			log.Printf("Error reloading PAC script after timeout: %v", err)
+		} else {
+			v = replacement
+		}
 	}
-	pr.vm = vm
-	return nil
+	pool.vms <- v
+	if err != nil {
+		return "", err
+	}
+	result, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("%s didn't return a string", pool.entryPoint)
+	}
+	return result, nil
 }
 
-func (pr *PACRunner) FindProxyForURL(u url.URL) (string, error) {
-	pr.Lock()
-	defer pr.Unlock()
+// pacURL returns the URL that should be passed to FindProxyForURL for a request to u.
+func pacURL(u url.URL) url.URL {
 	if u.Scheme == "" {
 		// When a net/http Server parses a CONNECT request, the URL will
 		// have no Scheme. In that case, assume the scheme is "https".
@@ -93,13 +560,7 @@ func (pr *PACRunner) FindProxyForURL(u url.URL) (string, error) {
 		u.RawQuery = ""
 		u.Fragment = ""
 	}
-	val, err := pr.vm.Call("FindProxyForURL", nil, u.String(), u.Hostname())
-	if err != nil {
-		return "", err
-	} else if !val.IsString() {
-		return "", errors.New("FindProxyForURL didn't return a string")
-	}
-	return val.String(), nil
+	return u
 }
 
 func toValue(unwrapped interface{}) otto.Value {
@@ -128,13 +589,13 @@ func localHostOrDomainIs(call otto.FunctionCall) otto.Value {
 	return toValue(host == hostdom || strings.HasPrefix(hostdom, host+"."))
 }
 
-func isResolvable(call otto.FunctionCall) otto.Value {
+func isResolvable(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
 	host := call.Argument(0).String()
-	_, err := net.LookupHost(host)
+	_, err := lookupHost(host)
 	return toValue(err == nil)
 }
 
-func isInNet(call otto.FunctionCall) otto.Value {
+func isInNet(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
 	host := call.Argument(0).String()
 	pattern := call.Argument(1).String()
 	mask := call.Argument(2).String()
@@ -144,22 +605,22 @@ func isInNet(call otto.FunctionCall) otto.Value {
 	}
 
 	m := net.IPv4Mask(buf[0], buf[1], buf[2], buf[3])
-	maskedIP := resolve(host).Mask(m)
+	maskedIP := resolve(host, lookupHost).Mask(m)
 	maskedPattern := net.ParseIP(pattern).To4().Mask(m)
 	return toValue(maskedIP.Equal(maskedPattern))
 }
 
-func dnsResolve(call otto.FunctionCall) otto.Value {
+func dnsResolve(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
 	host := call.Argument(0).String()
-	return toValue(resolve(host).String())
+	return toValue(resolve(host, lookupHost).String())
 }
 
-func resolve(host string) net.IP {
+func resolve(host string, lookupHost func(string) ([]string, error)) net.IP {
 	if ip := net.ParseIP(host); ip != nil {
 		// The given host is already an IP(v4) address; just return it.
 		return ip.To4()
 	}
-	addrs, err := net.LookupHost(host)
+	addrs, err := lookupHost(host)
 	if err != nil {
 		return nil
 	}
@@ -182,20 +643,20 @@ func convertAddr(call otto.FunctionCall) otto.Value {
 	return toValue(binary.BigEndian.Uint32(ipv4))
 }
 
-func myIpAddress(call otto.FunctionCall) otto.Value {
+func myIpAddress(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
 	// This function works like Chrome's myIpAddress() function, except
 	// that we avoid returning an IPv6 address.
 	// https://github.com/samuong/alpaca/issues/10
 	// https://chromium.googlesource.com/chromium/src/+/ee43fa5328856129f46566b2ea1be5811739681c/net/docs/proxy.md#Resolving-client_s-IP-address-within-a-PAC-script-using-myIpAddress
-	if localAddr := probeRoute("8.8.8.8"); localAddr != "" {
+	if localAddr := probeRoute("udp4", "8.8.8.8"); localAddr != "" {
 		return toValue(localAddr)
 	}
-	if ip := resolveHostname(); ip != "" {
+	if ip := resolveHostname(lookupHost); ip != "" {
 		return toValue(ip)
 	}
 	private := []string{"10.0.0.0", "172.16.0.0", "192.168.0.0"}
 	for _, remoteAddr := range private {
-		if localAddr := probeRoute(remoteAddr); localAddr != "" {
+		if localAddr := probeRoute("udp4", remoteAddr); localAddr != "" {
 			return toValue(localAddr)
 		}
 	}
@@ -205,11 +666,12 @@ func myIpAddress(call otto.FunctionCall) otto.Value {
 // probeRoute creates a UDP "connection" to the remote address, and returns the
 // local interface address. This does involve a system call, but does not
 // generate any network traffic since UDP is a connectionless protocol.
-func probeRoute(remote string) string {
-	conn, err := net.Dial("udp4", net.JoinHostPort(remote, "80"))
+func probeRoute(network, remote string) string {
+	conn, err := net.Dial(network, net.JoinHostPort(remote, "80"))
 	if err != nil {
 		return ""
 	}
+	defer conn.Close()
 	local, ok := conn.LocalAddr().(*net.UDPAddr)
 	if !ok {
 		// XXX: This is very unexpected, is it better to panic here?
@@ -225,24 +687,255 @@ func probeRoute(remote string) string {
 
 // resolveHostname does a DNS resolve of the machine's hostname, and returns
 // the first IPv4 result if there is one, or the empty string.
-func resolveHostname() string {
+func resolveHostname(lookupHost func(string) ([]string, error)) string {
+	for _, ip := range lookupHostname(lookupHost) {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+		if ipv4 := ip.To4(); len(ipv4) == net.IPv4len {
+			return ipv4.String()
+		}
+	}
+	return ""
+}
+
+// lookupHostname looks up the machine's hostname, using the same DNS lookups (and cache) as the
+// other PAC helper functions.
+func lookupHostname(lookupHost func(string) ([]string, error)) []net.IP {
 	host, err := os.Hostname()
 	if err != nil {
-		return ""
+		return nil
 	}
-	ips, err := net.LookupIP(host)
+	addrs, err := lookupHost(host)
 	if err != nil {
-		return ""
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
 	}
+	return ips
+}
+
+// The following functions are used instead of isInNet, dnsResolve and myIpAddress when IPv6
+// support is enabled. Where a host has both IPv4 and IPv6 addresses, they prefer IPv4, like
+// Chrome does, so that PAC scripts written for IPv4 networks behave the same way on dual-stack
+// networks. But unlike Chrome, they fall back to IPv6 rather than failing.
+
+// isInNetDualStack is like isInNet, but also accepts IPv6 patterns, and masks written as a
+// prefix length (e.g. "/64" or "64"). The host is resolved to an address of the same family as
+// the pattern, so a dual-stack host can match both IPv4 and IPv6 patterns.
+func isInNetDualStack(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
+	host := call.Argument(0).String()
+	pattern := net.ParseIP(call.Argument(1).String())
+	mask := call.Argument(2).String()
+	if pattern == nil {
+		return otto.FalseValue()
+	}
+	bits := net.IPv6len * 8
+	if pattern.To4() != nil {
+		pattern = pattern.To4()
+		bits = net.IPv4len * 8
+	}
+	var m net.IPMask
+	if n, err := strconv.Atoi(strings.TrimPrefix(mask, "/")); err == nil {
+		m = net.CIDRMask(n, bits)
+	} else if ip := net.ParseIP(mask); ip == nil {
+		return otto.FalseValue()
+	} else if bits == net.IPv4len*8 {
+		m = net.IPMask(ip.To4())
+	} else if ip.To4() == nil {
+		m = net.IPMask(ip.To16())
+	}
+	if ones, maskBits := m.Size(); ones == 0 && maskBits == 0 {
+		// The mask is missing, non-canonical (e.g. 255.0.255.0), or of the wrong family.
+		return otto.FalseValue()
+	}
+	for _, ip := range resolveAll(host, lookupHost) {
+		if (ip.To4() != nil) != (bits == net.IPv4len*8) {
+			continue
+		} else if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		return toValue(ip.Mask(m).Equal(pattern.Mask(m)))
+	}
+	return otto.FalseValue()
+}
+
+func dnsResolveDualStack(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
+	host := call.Argument(0).String()
+	ips := resolveAll(host, lookupHost)
 	for _, ip := range ips {
+		if ip.To4() != nil {
+			return toValue(ip.String())
+		}
+	}
+	if len(ips) > 0 {
+		return toValue(ips[0].String())
+	}
+	return otto.NullValue()
+}
+
+// resolveAll returns all of the addresses for the host, which may already be an IP address.
+func resolveAll(host string, lookupHost func(string) ([]string, error)) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// myIpAddressDualStack follows the same steps as myIpAddress, and returns the first IPv4
+// address that it finds. If there is none, it returns the first IPv6 address that it found.
+func myIpAddressDualStack(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
+	if localAddr := probeRoute("udp4", "8.8.8.8"); localAddr != "" {
+		return toValue(localAddr)
+	}
+	ipv6 := probeRoute("udp6", "2001:4860:4860::8888")
+	for _, addr := range resolveHostnameEx(lookupHost) {
+		if net.ParseIP(addr).To4() != nil {
+			return toValue(addr)
+		} else if ipv6 == "" {
+			ipv6 = addr
+		}
+	}
+	private := []string{"10.0.0.0", "172.16.0.0", "192.168.0.0"}
+	for _, remoteAddr := range private {
+		if localAddr := probeRoute("udp4", remoteAddr); localAddr != "" {
+			return toValue(localAddr)
+		}
+	}
+	if ipv6 == "" {
+		ipv6 = probeRoute("udp6", "FC00::")
+	}
+	if ipv6 != "" {
+		return toValue(ipv6)
+	}
+	return toValue("127.0.0.1")
+}
+
+// The following functions implement Microsoft's IPv6 extensions to PAC:
+// https://learn.microsoft.com/en-us/windows/win32/winhttp/ipv6-extensions-to-navigator-auto-config-file-format
+
+func isResolvableEx(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
+	return isResolvable(call, lookupHost)
+}
+
+// isInNetEx returns true if the IP address (which, unlike isInNet, can't be a hostname) is in
+// the given prefix, which is written in CIDR notation (e.g. "198.51.100.0/24" or "2001:db8::/32").
+func isInNetEx(call otto.FunctionCall) otto.Value {
+	addr, err := netip.ParseAddr(call.Argument(0).String())
+	if err != nil {
+		return otto.FalseValue()
+	}
+	prefix, err := netip.ParsePrefix(call.Argument(1).String())
+	if err != nil {
+		return otto.FalseValue()
+	}
+	return toValue(prefix.Contains(addr.Unmap()))
+}
+
+// dnsResolveEx returns a semicolon-separated list of all of the IPv4 and IPv6 addresses for the
+// given host, or the empty string if it can't be resolved.
+func dnsResolveEx(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
+	host := call.Argument(0).String()
+	if ip := net.ParseIP(host); ip != nil {
+		return toValue(ip.String())
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return toValue("")
+	}
+	return toValue(strings.Join(addrs, ";"))
+}
+
+// myIpAddressEx returns a semicolon-separated list of the machine's IPv4 and IPv6 addresses.
+// Like Chrome, rather than listing every address of every interface, this returns the addresses
+// that would be used to reach the public internet (or failing that, private networks).
+// https://chromium.googlesource.com/chromium/src/+/ee43fa5328856129f46566b2ea1be5811739681c/net/docs/proxy.md#Resolving-client_s-IP-address-within-a-PAC-script-using-myIpAddressEx
+func myIpAddressEx(call otto.FunctionCall, lookupHost func(string) ([]string, error)) otto.Value {
+	if addrs := probeRoutes("8.8.8.8", "2001:4860:4860::8888"); len(addrs) > 0 {
+		return toValue(strings.Join(addrs, ";"))
+	}
+	if addrs := resolveHostnameEx(lookupHost); len(addrs) > 0 {
+		return toValue(strings.Join(addrs, ";"))
+	}
+	private := []string{"10.0.0.0", "172.16.0.0", "192.168.0.0", "FC00::"}
+	if addrs := probeRoutes(private...); len(addrs) > 0 {
+		return toValue(strings.Join(addrs, ";"))
+	}
+	return toValue("")
+}
+
+// probeRoutes calls probeRoute for each of the remote addresses, and returns the distinct local
+// addresses that it finds.
+func probeRoutes(remotes ...string) []string {
+	var locals []string
+	for _, remote := range remotes {
+		if local := probeRoute("udp", remote); local != "" && !slices.Contains(locals, local) {
+			locals = append(locals, local)
+		}
+	}
+	return locals
+}
+
+// resolveHostnameEx is like resolveHostname, but returns all of the IPv4 and IPv6 addresses.
+func resolveHostnameEx(lookupHost func(string) ([]string, error)) []string {
+	var addrs []string
+	for _, ip := range lookupHostname(lookupHost) {
 		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
 			continue
 		}
-		if ipv4 := ip.To4(); len(ipv4) == net.IPv4len {
-			return ipv4.String()
+		addrs = append(addrs, ip.String())
+	}
+	return addrs
+}
+
+// sortIpAddressList sorts a semicolon-separated list of IP addresses, with IPv6 addresses
+// before IPv4 addresses (as in Chrome). It returns false if any of the addresses are invalid.
+func sortIpAddressList(call otto.FunctionCall) otto.Value {
+	list := call.Argument(0).String()
+	if !call.Argument(0).IsString() || list == "" {
+		return otto.FalseValue()
+	}
+	var ips []net.IP
+	for _, elem := range strings.Split(list, ";") {
+		ip := net.ParseIP(strings.TrimSpace(elem))
+		if ip == nil {
+			return otto.FalseValue()
 		}
+		ips = append(ips, ip)
 	}
-	return ""
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		if a4, b4 := a.To4() != nil, b.To4() != nil; a4 != b4 {
+			if b4 {
+				return -1
+			}
+			return 1
+		}
+		return bytes.Compare(a.To16(), b.To16())
+	})
+	sorted := make([]string, len(ips))
+	for i, ip := range ips {
+		sorted[i] = ip.String()
+	}
+	return toValue(strings.Join(sorted, ";"))
+}
+
+// getClientVersion returns the version of the Microsoft PAC extensions that we implement.
+func getClientVersion(call otto.FunctionCall) otto.Value {
+	return toValue("1.0")
 }
 
 func dnsDomainLevels(call otto.FunctionCall) otto.Value {
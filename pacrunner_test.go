@@ -15,9 +15,15 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,35 +33,231 @@ import (
 )
 
 func TestDirect(t *testing.T) {
-	var pr PACRunner
-	pacjs := []byte(`function FindProxyForURL(url, host) { return "DIRECT" }`)
-	require.NoError(t, pr.Update(pacjs))
-	proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "anz.com"})
-	require.NoError(t, err)
-	assert.Equal(t, "DIRECT", proxy)
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine}
+		pacjs := []byte(`function FindProxyForURL(url, host) { return "DIRECT" }`)
+		require.NoError(t, pr.Update(pacjs))
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "anz.com"})
+		require.NoError(t, err)
+		assert.Equal(t, "DIRECT", proxy)
+	})
 }
 
 func TestFindProxyForURL(t *testing.T) {
-	tests := []struct {
-		name, input, expected string
-	}{
-		{"NoScheme", "//alpaca.test", "https://alpaca.test/"},
-		{"HTTP", "http://alpaca.test/a?b=c#d", "http://alpaca.test/a?b=c#d"},
-		{"HTTPS", "https://alpaca.test/a?b=c#d", "https://alpaca.test/"},
-		{"WSS", "wss://alpaca.test/a?b=c#d", "wss://alpaca.test/"},
-	}
-	for _, test := range tests {
-		var pr PACRunner
-		pacjs := []byte("function FindProxyForURL(url, host) { return url }")
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		tests := []struct {
+			name, input, expected string
+		}{
+			{"NoScheme", "//alpaca.test", "https://alpaca.test/"},
+			{"HTTP", "http://alpaca.test/a?b=c#d", "http://alpaca.test/a?b=c#d"},
+			{"HTTPS", "https://alpaca.test/a?b=c#d", "https://alpaca.test/"},
+			{"WSS", "wss://alpaca.test/a?b=c#d", "wss://alpaca.test/"},
+		}
+		for _, test := range tests {
+			pr := PACRunner{engine: engine}
+			pacjs := []byte("function FindProxyForURL(url, host) { return url }")
+			require.NoError(t, pr.Update(pacjs))
+			t.Run(test.name, func(t *testing.T) {
+				u, err := url.Parse(test.input)
+				require.NoError(t, err)
+				proxy, err := pr.FindProxyForURL(*u)
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, proxy)
+			})
+		}
+	})
+}
+
+func TestConcurrentEvaluation(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		// Each lookup blocks until all of the goroutines are doing a lookup at the same time,
+		// which can only happen if the PAC script is evaluated in parallel.
+		const n = 4
+		var wg sync.WaitGroup
+		wg.Add(n)
+		pr := PACRunner{engine: engine, poolSize: n, lookupHost: func(host string) ([]string, error) {
+			wg.Done()
+			wg.Wait()
+			return []string{"192.0.2.1"}, nil
+		}}
+		pacjs := `function FindProxyForURL(url, host) {
+			return isResolvable(host) ? "PROXY %s:80" : "DIRECT";
+		}`
+		require.NoError(t, pr.Update([]byte(fmt.Sprintf(pacjs, "old.test"))))
+		results := make(chan string, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+				assert.NoError(t, err)
+				results <- proxy
+			}()
+		}
+		timeout := time.After(5 * time.Second)
+		for i := 0; i < n; i++ {
+			select {
+			case proxy := <-results:
+				assert.Equal(t, "PROXY old.test:80", proxy)
+			case <-timeout:
+				t.Fatal("timed out waiting for concurrent evaluations")
+			}
+		}
+		// Replacing the script swaps out the whole pool.
+		pr.lookupHost = func(string) ([]string, error) { return []string{"192.0.2.1"}, nil }
+		require.NoError(t, pr.Update([]byte(fmt.Sprintf(pacjs, "new.test"))))
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY new.test:80", proxy)
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine, poolSize: 1, timeout: 50 * time.Millisecond}
+		pacjs := []byte(`var count = 0;
+		function FindProxyForURL(url, host) {
+			count++;
+			while (host == "loop.test") {}
+			return "PROXY proxy.test:" + count;
+		}`)
 		require.NoError(t, pr.Update(pacjs))
-		t.Run(test.name, func(t *testing.T) {
-			u, err := url.Parse(test.input)
-			require.NoError(t, err)
-			proxy, err := pr.FindProxyForURL(*u)
-			require.NoError(t, err)
-			assert.Equal(t, test.expected, proxy)
-		})
-	}
+		_, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "loop.test"})
+		assert.ErrorIs(t, err, errPACTimeout)
+		// The VM that timed out is replaced with a fresh one, so the script starts again
+		// from a clean state, and the runner keeps working.
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY proxy.test:1", proxy)
+		proxy, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "other.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY proxy.test:2", proxy)
+	})
+}
+
+func TestTimeoutWhileLoading(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine, poolSize: 1, timeout: 50 * time.Millisecond}
+		pacjs := []byte(`function FindProxyForURL(url, host) { return "DIRECT" }`)
+		require.NoError(t, pr.Update(pacjs))
+		err := pr.Update([]byte(`for (;;) {}`))
+		assert.ErrorIs(t, err, errPACTimeout)
+		// The previous script is still used.
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "DIRECT", proxy)
+	})
+}
+
+func TestScriptTooBig(t *testing.T) {
+	var pr PACRunner
+	pacjs := "function FindProxyForURL(url, host) { return \"DIRECT\" }\n"
+	pacjs += "//" + strings.Repeat("x", maxResponseBytes)
+	assert.Error(t, pr.Update([]byte(pacjs)))
+}
+
+func TestFallback(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine, fallback: "PROXY fallback.test:80"}
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			if (host == "error.test") throw "oops";
+			return "DIRECT";
+		}`)
+		require.NoError(t, pr.Update(pacjs))
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "error.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY fallback.test:80", proxy)
+		proxy, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "DIRECT", proxy)
+	})
+}
+
+func TestValidateEntryPoint(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine}
+		err := pr.Update([]byte(`function findProxyForURL(url, host) { return "DIRECT" }`))
+		assert.EqualError(t, err, "PAC script doesn't define FindProxyForURL")
+		assert.False(t, pr.loaded())
+	})
+}
+
+func TestValidateProbeURLs(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		probes := []url.URL{
+			{Scheme: "https", Host: "www.test"},
+			{Scheme: "http", Host: "intranet"},
+		}
+		pr := PACRunner{engine: engine, probeURLs: probes}
+		require.NoError(t, pr.Update([]byte(`function FindProxyForURL(url, host) {
+			return isPlainHostName(host) ? "DIRECT" : "PROXY proxy.test:80";
+		}`)))
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(io.Discard)
+		// A script that fails for some of the probe URLs is still used, but the changes in
+		// behaviour are logged.
+		require.NoError(t, pr.Update([]byte(`function FindProxyForURL(url, host) {
+			if (isPlainHostName(host)) throw "oops";
+			return "PROXY proxy.test:80";
+		}`)))
+		assert.Contains(t, logs.String(), `New PAC script changes the result for http://intranet from "DIRECT" to error (oops`)
+		assert.NotContains(t, logs.String(), "https://www.test/ from")
+		// A script that fails for all of the probe URLs is rejected.
+		err := pr.Update([]byte(`function FindProxyForURL(url, host) { return undefinedVariable }`))
+		assert.ErrorContains(t, err, "PAC script failed for every probe URL")
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY proxy.test:80", proxy)
+	})
+}
+
+func TestUpdateDuringEvaluation(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine, poolSize: 2}
+		pacjs := `function FindProxyForURL(url, host) { return "PROXY %d.test:80" }`
+		require.NoError(t, pr.Update([]byte(fmt.Sprintf(pacjs, 0))))
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test"})
+					assert.NoError(t, err)
+					assert.Regexp(t, `^PROXY \d+\.test:80$`, proxy)
+				}
+			}()
+		}
+		for i := 1; i <= 10; i++ {
+			require.NoError(t, pr.Update([]byte(fmt.Sprintf(pacjs, i))))
+		}
+		wg.Wait()
+	})
+}
+
+func TestTrace(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine, lookupHost: func(host string) ([]string, error) {
+			return []string{"10.1.2.3"}, nil
+		}}
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			if (isPlainHostName(host) || isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0"))
+				return "DIRECT";
+			return "PROXY proxy.test:80";
+		}`)
+		require.NoError(t, pr.Update(pacjs))
+		trace := pr.Trace(url.URL{Scheme: "https", Host: "internal.test", Path: "/a"})
+		require.NoError(t, trace.Err)
+		assert.Equal(t, "DIRECT", trace.Result)
+		assert.Equal(t, `isPlainHostName("internal.test") = false
+dnsResolve("internal.test") = "10.1.2.3"
+isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0") = true
+FindProxyForURL("https://internal.test/", "internal.test") = "DIRECT"
+`, trace.String())
+		// Calls are only recorded while tracing.
+		_, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "internal.test"})
+		require.NoError(t, err)
+		assert.Len(t, pr.Trace(url.URL{Scheme: "http", Host: "www"}).Calls, 1)
+	})
 }
 
 func TestIsPlainHostName(t *testing.T) {
@@ -138,7 +340,8 @@ func TestIsResolvable(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.host, func(t *testing.T) {
 			vm := otto.New()
-			require.NoError(t, vm.Set("isResolvable", isResolvable))
+			f := func(fc otto.FunctionCall) otto.Value { return isResolvable(fc, net.LookupHost) }
+			require.NoError(t, vm.Set("isResolvable", f))
 			value, err := vm.Call("isResolvable", nil, test.host)
 			require.NoError(t, err)
 			actual, err := value.ToBoolean()
@@ -164,7 +367,8 @@ func TestIsInNet(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.host, func(t *testing.T) {
 			vm := otto.New()
-			require.NoError(t, vm.Set("isInNet", isInNet))
+			f := func(fc otto.FunctionCall) otto.Value { return isInNet(fc, net.LookupHost) }
+			require.NoError(t, vm.Set("isInNet", f))
 			value, err := vm.Call("isInNet", nil, test.host, test.pattern, test.mask)
 			require.NoError(t, err)
 			actual, err := value.ToBoolean()
@@ -174,6 +378,116 @@ func TestIsInNet(t *testing.T) {
 	}
 }
 
+// fakeDualStackLookup resolves hostnames that describe the address families they have.
+func fakeDualStackLookup(host string) ([]string, error) {
+	switch host {
+	case "dualstack.test":
+		return []string{"2001:db8:1::1", "192.0.2.1"}, nil
+	case "ipv4only.test":
+		return []string{"192.0.2.2"}, nil
+	case "ipv6only.test":
+		return []string{"2001:db8:2::1", "2001:db8:3::1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestIsInNetDualStack(t *testing.T) {
+	tests := []struct {
+		host     string
+		pattern  string
+		mask     string
+		expected bool
+	}{
+		// IPv4 patterns and masks work as before.
+		{"192.0.2.1", "192.0.2.0", "255.255.255.0", true},
+		{"192.0.3.1", "192.0.2.0", "255.255.255.0", false},
+		{"192.0.3.1", "192.0.2.0", "255.255.255", false},
+		{"192.0.3.1", "192.0.2.0", "255.0.255.0", false},
+		// Masks can also be written as a prefix length.
+		{"192.0.2.1", "192.0.2.0", "/24", true},
+		{"192.0.2.1", "192.0.2.0", "24", true},
+		{"192.0.3.1", "192.0.2.0", "/24", false},
+		{"192.0.3.1", "192.0.2.0", "/33", false},
+		// IPv6 patterns, with either kind of mask.
+		{"2001:db8:1::1", "2001:db8::", "/32", true},
+		{"2001:db8:1::1", "2001:db8::", "ffff:ffff::", true},
+		{"2001:db8:1::1", "2001:db8:2::", "/48", false},
+		{"2001:db8:1::1", "2001:db8::", "255.255.0.0", false},
+		// Dual-stack hosts match patterns of either family.
+		{"dualstack.test", "192.0.2.0", "255.255.255.0", true},
+		{"dualstack.test", "2001:db8:1::", "/48", true},
+		{"dualstack.test", "2001:db8:2::", "/48", false},
+		// Single-stack hosts never match patterns of the other family.
+		{"ipv4only.test", "192.0.2.0", "/24", true},
+		{"ipv4only.test", "::", "/0", false},
+		{"ipv6only.test", "0.0.0.0", "0.0.0.0", false},
+		{"ipv6only.test", "2001:db8:2::", "/48", true},
+		{"ipv6only.test", "2001:db8:3::", "/48", false},
+		{"nonexistent.test", "0.0.0.0", "0.0.0.0", false},
+	}
+	for _, test := range tests {
+		t.Run(test.host+" "+test.pattern+" "+test.mask, func(t *testing.T) {
+			vm := otto.New()
+			f := func(fc otto.FunctionCall) otto.Value {
+				return isInNetDualStack(fc, fakeDualStackLookup)
+			}
+			require.NoError(t, vm.Set("isInNet", f))
+			value, err := vm.Call("isInNet", nil, test.host, test.pattern, test.mask)
+			require.NoError(t, err)
+			actual, err := value.ToBoolean()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestDnsResolveDualStack(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected interface{}
+	}{
+		{"dualstack.test", "192.0.2.1"},
+		{"ipv4only.test", "192.0.2.2"},
+		{"ipv6only.test", "2001:db8:2::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"nonexistent.test", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			vm := otto.New()
+			f := func(fc otto.FunctionCall) otto.Value {
+				return dnsResolveDualStack(fc, fakeDualStackLookup)
+			}
+			require.NoError(t, vm.Set("dnsResolve", f))
+			value, err := vm.Call("dnsResolve", nil, test.host)
+			require.NoError(t, err)
+			actual, err := value.Export()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestIPv6Mode(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			return isInNet(host, "2001:db8::", "/32") ? "DIRECT" : "PROXY proxy.test:80";
+		}`)
+		u := url.URL{Scheme: "http", Host: "ipv6only.test"}
+		for _, ipv6 := range []bool{false, true} {
+			pr := PACRunner{engine: engine, lookupHost: fakeDualStackLookup, ipv6: ipv6}
+			require.NoError(t, pr.Update(pacjs))
+			proxy, err := pr.FindProxyForURL(u)
+			require.NoError(t, err)
+			if ipv6 {
+				assert.Equal(t, "DIRECT", proxy)
+			} else {
+				assert.Equal(t, "PROXY proxy.test:80", proxy)
+			}
+		}
+	})
+}
+
 func TestDnsResolve(t *testing.T) {
 	tests := []struct {
 		host     string
@@ -185,7 +499,8 @@ func TestDnsResolve(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.host, func(t *testing.T) {
 			vm := otto.New()
-			require.NoError(t, vm.Set("dnsResolve", dnsResolve))
+			f := func(fc otto.FunctionCall) otto.Value { return dnsResolve(fc, net.LookupHost) }
+			require.NoError(t, vm.Set("dnsResolve", f))
 			value, err := vm.Call("dnsResolve", nil, test.host)
 			require.NoError(t, err)
 			actual, err := value.ToString()
@@ -218,8 +533,15 @@ func TestConvertAddr(t *testing.T) {
 }
 
 func TestMyIpAddress(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) { testMyIpAddress(t, myIpAddress) })
+	t.Run("DualStack", func(t *testing.T) { testMyIpAddress(t, myIpAddressDualStack) })
+}
+
+func testMyIpAddress(t *testing.T, myIpAddress func(otto.FunctionCall, func(string) ([]string, error)) otto.Value) {
 	vm := otto.New()
-	require.NoError(t, vm.Set("myIpAddress", myIpAddress))
+	require.NoError(t, vm.Set("myIpAddress", func(fc otto.FunctionCall) otto.Value {
+		return myIpAddress(fc, net.LookupHost)
+	}))
 	value, err := vm.Call("myIpAddress", nil)
 	require.NoError(t, err)
 	output, err := value.ToString()
@@ -239,6 +561,143 @@ func TestMyIpAddress(t *testing.T) {
 	t.Fail()
 }
 
+func TestFindProxyForURLEx(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		pr := PACRunner{engine: engine}
+		pacjs := []byte(`
+			function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }
+			function FindProxyForURLEx(url, host) { return "PROXY ex.test:80; " + getClientVersion() }
+		`)
+		require.NoError(t, pr.Update(pacjs))
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "anz.com"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY ex.test:80; 1.0", proxy)
+	})
+}
+
+func TestIsInNetEx(t *testing.T) {
+	tests := []struct {
+		ipaddr   string
+		prefix   string
+		expected bool
+	}{
+		{"198.95.249.79", "198.95.249.79/32", true},
+		{"198.95.249.79", "198.95.0.0/16", true},
+		{"198.96.249.79", "198.95.0.0/16", false},
+		{"3ffe:8311:ffff:1:0:0:0:80", "3ffe:8311:ffff::/48", true},
+		{"3ffe:8311:fffe:1:0:0:0:80", "3ffe:8311:ffff::/48", false},
+		{"::ffff:192.0.2.1", "192.0.2.0/24", true},
+		{"192.0.2.1", "2001:db8::/32", false},
+		{"localhost", "127.0.0.0/8", false},
+		{"192.0.2.1", "192.0.2.0", false},
+	}
+	for _, test := range tests {
+		t.Run(test.ipaddr+" "+test.prefix, func(t *testing.T) {
+			vm := otto.New()
+			require.NoError(t, vm.Set("isInNetEx", isInNetEx))
+			value, err := vm.Call("isInNetEx", nil, test.ipaddr, test.prefix)
+			require.NoError(t, err)
+			actual, err := value.ToBoolean()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestDnsResolveEx(t *testing.T) {
+	lookupHost := func(host string) ([]string, error) {
+		if host == "dualstack.test" {
+			return []string{"192.0.2.1", "2001:db8::1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"dualstack.test", "192.0.2.1;2001:db8::1"},
+		{"2001:db8::2", "2001:db8::2"},
+		{"nonexistent.test", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			vm := otto.New()
+			f := func(fc otto.FunctionCall) otto.Value { return dnsResolveEx(fc, lookupHost) }
+			require.NoError(t, vm.Set("dnsResolveEx", f))
+			value, err := vm.Call("dnsResolveEx", nil, test.host)
+			require.NoError(t, err)
+			actual, err := value.ToString()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestResolveHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	var looked []string
+	lookupHost := func(host string) ([]string, error) {
+		looked = append(looked, host)
+		return []string{"127.0.0.1", "2001:db8::1", "192.0.2.1"}, nil
+	}
+	assert.Equal(t, "192.0.2.1", resolveHostname(lookupHost))
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1"}, resolveHostnameEx(lookupHost))
+	assert.Equal(t, []string{hostname, hostname}, looked)
+}
+
+func TestMyIpAddressEx(t *testing.T) {
+	vm := otto.New()
+	require.NoError(t, vm.Set("myIpAddressEx", func(fc otto.FunctionCall) otto.Value {
+		return myIpAddressEx(fc, net.LookupHost)
+	}))
+	value, err := vm.Call("myIpAddressEx", nil)
+	require.NoError(t, err)
+	output, err := value.ToString()
+	require.NoError(t, err)
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	if output == "" {
+		// This can happen on machines with no network connectivity at all.
+		return
+	}
+	for _, ip := range strings.Split(output, ";") {
+		assert.NotNil(t, net.ParseIP(ip))
+		found := false
+		for _, addr := range addrs {
+			found = found || strings.HasPrefix(addr.String(), ip+"/")
+		}
+		assert.True(t, found, "%s is not one of our addresses", ip)
+	}
+}
+
+func TestSortIpAddressList(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    interface{}
+		expected interface{}
+	}{
+		{"IPv4", "10.2.3.9;10.2.3.18;10.1.4.1", "10.1.4.1;10.2.3.9;10.2.3.18"},
+		{"Mixed", "192.0.2.1; 2001:db8::2;10.0.0.1;2001:db8::1",
+			"2001:db8::1;2001:db8::2;10.0.0.1;192.0.2.1"},
+		{"Single", "::1", "::1"},
+		{"Invalid", "10.0.0.1;www.test", false},
+		{"Empty", "", false},
+		{"NotAString", 42, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := otto.New()
+			require.NoError(t, vm.Set("sortIpAddressList", sortIpAddressList))
+			value, err := vm.Call("sortIpAddressList", nil, test.input)
+			require.NoError(t, err)
+			actual, err := value.Export()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
 func TestDnsDomainLevels(t *testing.T) {
 	tests := []struct {
 		host     string
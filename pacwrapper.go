@@ -16,72 +16,365 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 // PACData contains program configuration to be made available to the pacWrapTmpl.
 type PACData struct {
+	Host string // The address that clients use to connect to alpaca ("localhost" if empty)
 	Port int
+	// If true, the served PAC file tells clients to connect directly when they can't connect
+	// to alpaca (e.g. because it isn't running).
+	DirectFallback bool
+	// The result that alpaca uses when the upstream PAC script fails (see -pac-fallback), or
+	// "" if alpaca fails the request instead.
+	PACFallback string
+	// The address (host or host:port) to give to clients that connect to alpaca via a
+	// particular interface, keyed by interface name (e.g. "docker0") or local IP address.
+	Addresses map[string]string
 }
 
 type pacData struct {
 	PACData
+	Proxy       string   // What the served PAC file returns to send a request via alpaca
+	ProxyHosts  []string // Host patterns that are always sent via alpaca
 	UpstreamPAC string
 }
 
 type PACWrapper struct {
-	data      pacData
-	tmpl      *template.Template
-	alpacaPAC string
+	data     PACData
+	tmpl     *template.Template
+	upstream string
+	// Reports whether alpaca is using the upstream PAC script (rather than connecting
+	// directly). If nil, it's used whenever it has been downloaded.
+	online func() bool
+	// Returns the host patterns that alpaca needs to see requests for, even if the upstream
+	// PAC script says to connect directly (e.g. because they're intercepted using -mitm).
+	proxyHosts func() []string
+	// Returns the name of the network interface with a local IP address. If nil, the
+	// system's interfaces are searched.
+	interfaceName func(ip net.IP) string
+	// The runner whose settings (engine, timeout, etc) are used to run the served PAC file on
+	// the debug page. If nil, the defaults are used.
+	runner *PACRunner
+	// The state that the served PAC file was last generated from, and when that changed. The
+	// served PAC file depends on the client's address too, but that doesn't change over time.
+	generation string
+	modified   time.Time
+	now        func() time.Time
+	mux        sync.Mutex
 }
 
 // PACWrapper template for serving a PAC file to point at alpaca or DIRECT. If we have a valid
-// PAC file, we wrap that PAC file with a wrapper function that only returns "DIRECT" or
-// "localhost:port". If we do not have a PAC file, the PAC function we serve only returns "DIRECT",
-// which should prevent all requests reaching us.
+// PAC file, we wrap that PAC file with a wrapper function that returns "DIRECT" whenever alpaca
+// would connect directly, and alpaca's address otherwise. If we do not have a PAC file (or
+// we're offline), the PAC function we serve only returns "DIRECT", which should prevent all
+// requests reaching us (except for the hosts that alpaca needs to see).
+//
+// The upstream PAC file runs inside its own function, so that its top-level declarations
+// (however its FindProxyForURL function is defined) can't replace or call the wrapper. Like
+// alpaca, the wrapper uses FindProxyForURLEx instead of FindProxyForURL if it's defined.
 var pacWrapTmpl = `// Wrapped for and by alpaca
-function FindProxyForURL(url, host) {
-{{ if .UpstreamPAC }}
-  return FindProxyForURL(url, host) === "DIRECT" ? "DIRECT" : "PROXY localhost:{{.Port}}";
+{{- if .UpstreamPAC }}
+var alpacaWrapper = FindProxyForURL;
+var alpacaUpstream = (function () {
 {{.UpstreamPAC}}
-{{ else }}
+;
+  if (typeof FindProxyForURLEx === "function") return FindProxyForURLEx;
+  if (typeof FindProxyForURL === "function" && FindProxyForURL !== alpacaWrapper) return FindProxyForURL;
+  return null;
+})();
+// In case the upstream PAC file assigned to FindProxyForURL without declaring it.
+FindProxyForURL = alpacaWrapper;
+
+// This mirrors how alpaca parses the result: unsupported entries are skipped, and the first
+// supported one decides whether to connect directly.
+function alpacaIsDirect(result) {
+  var entries = String(result).split(";");
+  for (var i = 0; i < entries.length; i++) {
+    var fields = entries[i].replace(/^\s+|\s+$/g, "").split(/\s+/);
+    if (fields[0] === "DIRECT") return true;
+    if (fields.length === 2 && /^(PROXY|HTTPS?)$/.test(fields[0])) return false;
+  }
+  return false;
+}
+{{- end }}
+
+function FindProxyForURL(url, host) {
+  var alpacaProxy = {{ js .Proxy }};
+{{- range .ProxyHosts }}
+  if (shExpMatch(host.toLowerCase(), {{ js . }})) return alpacaProxy;
+{{- end }}
+{{- if .UpstreamPAC }}
+  var result;
+  try {
+    result = alpacaUpstream(url, host);
+  } catch (e) {
+{{- if .PACFallback }}
+    result = {{ js .PACFallback }};
+{{- else }}
+    return alpacaProxy;
+{{- end }}
+  }
+  return alpacaIsDirect(result) ? "DIRECT" : alpacaProxy;
+{{- else }}
   return "DIRECT";
-{{ end }}
+{{- end }}
 }
 `
 
 func NewPACWrapper(data PACData) *PACWrapper {
-	t := template.Must(template.New("alpaca").Parse(pacWrapTmpl))
-	return &PACWrapper{pacData{data, ""}, t, ""}
+	funcs := template.FuncMap{"js": jsString}
+	t := template.Must(template.New("alpaca").Funcs(funcs).Parse(pacWrapTmpl))
+	return &PACWrapper{data: data, tmpl: t, now: time.Now}
+}
+
+// jsString quotes a string as a JavaScript string literal.
+func jsString(s string) (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
 }
 
 func (pw *PACWrapper) Wrap(pacjs []byte) {
-	pac := string(pacjs)
-	if pac == pw.data.UpstreamPAC && pw.alpacaPAC != "" {
-		return
+	pw.mux.Lock()
+	defer pw.mux.Unlock()
+	pw.upstream = string(pacjs)
+}
+
+// proxy returns the value that the served PAC script returns for requests that should be sent
+// via alpaca, for a client that connected to alpaca via a local IP address (which may be nil).
+func (pw *PACWrapper) proxy(local net.IP) string {
+	host, port := pw.data.Host, strconv.Itoa(pw.data.Port)
+	if addr, ok := pw.address(local); ok {
+		if h, p, err := net.SplitHostPort(addr); err == nil {
+			host, port = h, p
+		} else {
+			host = addr
+		}
+	} else if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		// Alpaca is listening on every interface, so use the one that the client connected
+		// to (or the one that's always there).
+		host = "localhost"
+		if local != nil && !local.IsLoopback() && !local.IsUnspecified() {
+			host = local.String()
+		}
 	}
-	pw.data.UpstreamPAC = pac
-	b := &bytes.Buffer{}
-	if err := pw.tmpl.Execute(b, pw.data); err != nil {
-		log.Printf("error executing PAC wrap template: %v", err)
-		return
+	proxy := "PROXY " + net.JoinHostPort(host, port)
+	if pw.data.DirectFallback {
+		proxy += "; DIRECT"
+	}
+	return proxy
+}
+
+// address returns the address that's configured for clients that connect to alpaca via a local
+// IP address, if there is one.
+func (pw *PACWrapper) address(local net.IP) (string, bool) {
+	if local == nil || len(pw.data.Addresses) == 0 {
+		return "", false
+	}
+	if addr, ok := pw.data.Addresses[local.String()]; ok {
+		return addr, true
+	}
+	lookup := pw.interfaceName
+	if lookup == nil {
+		lookup = interfaceName
+	}
+	if name := lookup(local); name != "" {
+		addr, ok := pw.data.Addresses[name]
+		return addr, ok
+	}
+	return "", false
+}
+
+// interfaceName returns the name of the network interface that has an IP address, or "" if
+// there isn't one.
+func interfaceName(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("Error listing network interfaces: %v", err)
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// localIP returns the local IP address that a request was received on, or nil if it isn't
+// known.
+func localIP(req *http.Request) net.IP {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
 	}
-	pw.alpacaPAC = b.String()
+	host, _, _ = strings.Cut(host, "%")
+	return net.ParseIP(host)
+}
+
+// pac generates the PAC script to serve to a client that connected to alpaca via a local IP
+// address, based on the current upstream PAC script and state. It also returns the time that
+// the PAC script last changed.
+func (pw *PACWrapper) pac(local net.IP) (string, time.Time, error) {
+	pw.mux.Lock()
+	upstream := pw.upstream
+	pw.mux.Unlock()
+	data := pacData{PACData: pw.data, Proxy: pw.proxy(local), UpstreamPAC: upstream}
+	if pw.online != nil && !pw.online() {
+		data.UpstreamPAC = ""
+	}
+	if pw.proxyHosts != nil {
+		data.ProxyHosts = pw.proxyHosts()
+	}
+	var b bytes.Buffer
+	if err := pw.tmpl.Execute(&b, data); err != nil {
+		return "", time.Time{}, err
+	}
+	return b.String(), pw.touch(data), nil
+}
+
+// touch records the state that a PAC script was generated from, and returns the time that the
+// state last changed.
+func (pw *PACWrapper) touch(data pacData) time.Time {
+	h := sha256.New()
+	_, _ = io.WriteString(h, data.UpstreamPAC)
+	for _, host := range data.ProxyHosts {
+		_, _ = io.WriteString(h, "\x00"+host)
+	}
+	generation := string(h.Sum(nil))
+	pw.mux.Lock()
+	defer pw.mux.Unlock()
+	if generation != pw.generation {
+		pw.generation = generation
+		// HTTP dates only have a resolution of one second.
+		pw.modified = pw.now().UTC().Truncate(time.Second)
+	}
+	return pw.modified
 }
 
 func (pw *PACWrapper) SetupHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/alpaca.pac", pw.handlePAC)
+	// These are where WPAD clients, and some tools, look for a PAC file.
+	mux.HandleFunc("/wpad.dat", pw.handlePAC)
+	mux.HandleFunc("/proxy.pac", pw.handlePAC)
 }
 
 func (pw *PACWrapper) handlePAC(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	pac, modified, err := pw.pac(localIP(req))
+	if err != nil {
+		log.Printf("error executing PAC wrap template: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if req.URL.Query().Has("debug") {
+		pw.handleDebug(w, req, pac)
+		return
+	}
+	sum := sha256.Sum256([]byte(pac))
 	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
-	if _, err := w.Write([]byte(pw.alpacaPAC)); err != nil {
-		log.Printf("Error writing PAC to response: %v", err)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	// The PAC script changes whenever the upstream one does, so clients need to check.
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, req, "", modified, strings.NewReader(pac))
+}
+
+var pacDebugTmpl = htmltemplate.Must(htmltemplate.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>alpaca.pac</title></head>
+<body>
+<h1>alpaca.pac</h1>
+<dl>
+<dt>Proxy</dt><dd><code>{{ .Proxy }}</code></dd>
+<dt>Upstream PAC script</dt><dd>{{ if .Upstream }}in use{{ else }}not in use (everything is DIRECT){{ end }}</dd>
+<dt>Always via alpaca</dt><dd>{{ range .ProxyHosts }}<code>{{ . }}</code> {{ else }}(none){{ end }}</dd>
+</dl>
+<form>
+<input type="hidden" name="debug">
+<input type="text" name="url" size="60" placeholder="https://www.example.com/" value="{{ .URL }}">
+<input type="submit" value="Test">
+</form>
+{{ if .URL }}<p>FindProxyForURL returns: <code>{{ if .Err }}error: {{ .Err }}{{ else }}{{ printf "%q" .Result }}{{ end }}</code></p>{{ end }}
+<pre>{{ .PAC }}</pre>
+</body>
+</html>
+`))
+
+// handleDebug serves an HTML page that shows the PAC script that's being served, and lets the
+// user test it. Since testing a URL runs the upstream PAC script, this is only available to
+// clients connecting from a loopback address.
+func (pw *PACWrapper) handleDebug(w http.ResponseWriter, req *http.Request, pac string) {
+	if !isLoopback(req.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	data := struct {
+		Proxy      string
+		Upstream   bool
+		ProxyHosts []string
+		URL        string
+		Result     string
+		Err        error
+		PAC        string
+	}{Proxy: pw.proxy(localIP(req)), URL: req.URL.Query().Get("url"), PAC: pac}
+	pw.mux.Lock()
+	data.Upstream = pw.upstream != "" && (pw.online == nil || pw.online())
+	pw.mux.Unlock()
+	if pw.proxyHosts != nil {
+		data.ProxyHosts = pw.proxyHosts()
+	}
+	if data.URL != "" {
+		data.Result, data.Err = evaluatePAC(pw.runner, pac, data.URL)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pacDebugTmpl.Execute(w, data); err != nil {
+		log.Printf("Error writing PAC debug page to response: %v", err)
+	}
+}
+
+// evaluatePAC runs a PAC script for a URL, using the same settings as the given runner (or the
+// defaults, if it's nil).
+func evaluatePAC(runner *PACRunner, pac, rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	} else if u.Host == "" {
+		return "", errors.New("URL must be absolute (e.g. https://www.example.com/)")
+	}
+	if runner == nil {
+		runner = new(PACRunner)
+	}
+	pr := runner.clone()
+	if err := pr.Update([]byte(pac)); err != nil {
+		return "", err
 	}
+	return pr.FindProxyForURL(*u)
 }
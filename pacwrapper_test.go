@@ -15,27 +15,116 @@
 package main
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// evaluateWrapped returns the result of the PAC script served by the wrapper for a URL.
+func evaluateWrapped(t *testing.T, pw *PACWrapper, rawurl string) string {
+	pac, _, err := pw.pac(nil)
+	require.NoError(t, err)
+	result, err := evaluatePAC(nil, pac, rawurl)
+	require.NoError(t, err)
+	return result
+}
+
 func TestWrapPAC(t *testing.T) {
 	pw := NewPACWrapper(PACData{Port: 1234})
-	pac := `function FindProxyForURL(url, host) { return "DIRECT" }`
+	pac := `function FindProxyForURL(url, host) {
+  return dnsDomainIs(host, ".internal.test") ? "DIRECT" : "PROXY proxy.test:80";
+}`
 	pw.Wrap([]byte(pac))
-	assert.Contains(t, pw.alpacaPAC, pac)
-	assert.Contains(t, pw.alpacaPAC, `"DIRECT" : "PROXY localhost:1234"`)
+	assert.Equal(t, "DIRECT", evaluateWrapped(t, pw, "http://www.internal.test/"))
+	assert.Equal(t, "PROXY localhost:1234", evaluateWrapped(t, pw, "http://www.test/"))
 }
 
 func TestWrapEmptyPAC(t *testing.T) {
 	pw := NewPACWrapper(PACData{Port: 1234})
 	pw.Wrap(nil)
-	assert.Contains(t, pw.alpacaPAC, `return "DIRECT"`)
+	assert.Equal(t, "DIRECT", evaluateWrapped(t, pw, "http://www.test/"))
+}
+
+func TestWrapPACResults(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   string
+		expected string
+	}{
+		{"Direct", "DIRECT", "DIRECT"},
+		{"Proxy", "PROXY proxy.test:80", "PROXY localhost:1"},
+		{"DirectFirst", "DIRECT; PROXY proxy.test:80", "DIRECT"},
+		{"ProxyFirst", "PROXY proxy.test:80; DIRECT", "PROXY localhost:1"},
+		{"UnsupportedThenDirect", " SOCKS socks.test:1080 ;DIRECT", "DIRECT"},
+		{"UnsupportedThenProxy", "SOCKS socks.test:1080; HTTPS proxy.test", "PROXY localhost:1"},
+		{"Nothing", "", "PROXY localhost:1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pw := NewPACWrapper(PACData{Port: 1})
+			pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "` + test.result + `" }`))
+			assert.Equal(t, test.expected, evaluateWrapped(t, pw, "http://www.test/"))
+		})
+	}
+}
+
+func TestWrapPACProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     PACData
+		expected string
+	}{
+		{"Default", PACData{Port: 1}, "PROXY localhost:1"},
+		{"Host", PACData{Host: "192.0.2.1", Port: 1}, "PROXY 192.0.2.1:1"},
+		{"IPv6", PACData{Host: "::1", Port: 1}, "PROXY [::1]:1"},
+		{"AllInterfaces", PACData{Host: "0.0.0.0", Port: 1}, "PROXY localhost:1"},
+		{"DirectFallback", PACData{Port: 1, DirectFallback: true}, "PROXY localhost:1; DIRECT"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pw := NewPACWrapper(test.data)
+			pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`))
+			assert.Equal(t, test.expected, evaluateWrapped(t, pw, "http://www.test/"))
+		})
+	}
+}
+
+func TestWrapPACError(t *testing.T) {
+	pac := `function FindProxyForURL(url, host) {
+  if (host == "www.test") throw "oops";
+  return "DIRECT";
+}`
+	pw := NewPACWrapper(PACData{Port: 1})
+	pw.Wrap([]byte(pac))
+	// Alpaca fails the request, but the client should still send it to alpaca.
+	assert.Equal(t, "PROXY localhost:1", evaluateWrapped(t, pw, "http://www.test/"))
+	assert.Equal(t, "DIRECT", evaluateWrapped(t, pw, "http://other.test/"))
+	pw = NewPACWrapper(PACData{Port: 1, PACFallback: "DIRECT"})
+	pw.Wrap([]byte(pac))
+	assert.Equal(t, "DIRECT", evaluateWrapped(t, pw, "http://www.test/"))
+}
+
+func TestWrapPACOfflineAndProxyHosts(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`))
+	online := true
+	pw.online = func() bool { return online }
+	pw.proxyHosts = func() []string { return []string{"*.mitm.test"} }
+	assert.Equal(t, "PROXY localhost:1", evaluateWrapped(t, pw, "http://www.test/"))
+	// When alpaca is offline, it connects directly, except for the hosts that it needs to see.
+	online = false
+	assert.Equal(t, "DIRECT", evaluateWrapped(t, pw, "http://www.test/"))
+	assert.Equal(t, "PROXY localhost:1", evaluateWrapped(t, pw, "http://WWW.mitm.test/"))
 }
 
 func TestPACServe(t *testing.T) {
@@ -47,15 +136,239 @@ func TestPACServe(t *testing.T) {
 	server := httptest.NewServer(mux)
 	defer server.Close()
 
-	resp, err := http.Get(server.URL + "/alpaca.pac")
-	require.NoError(t, err)
+	for _, path := range []string{"/alpaca.pac", "/wpad.dat", "/proxy.pac"} {
+		t.Run(path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Equal(t, "application/x-ns-proxy-autoconfig", resp.Header.Get("Content-Type"))
+			assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+			b, err := io.ReadAll(resp.Body)
+			body := string(b)
+			require.NoError(t, err)
+			assert.Contains(t, body, pac)
+			// The client connected to alpaca via a loopback address.
+			assert.Contains(t, body, `"PROXY localhost:1234"`)
+		})
+	}
+}
+
+func TestPACCaching(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234})
+	now := time.Date(2026, time.March, 1, 9, 0, 0, 500, time.UTC)
+	pw.now = func() time.Time { return now }
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "DIRECT" }`))
+	mux := http.NewServeMux()
+	pw.SetupHandlers(mux)
+	get := func(header http.Header) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/wpad.dat", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := get(http.Header{})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "Sun, 01 Mar 2026 09:00:00 GMT", resp.Header.Get("Last-Modified"))
+
+	// Nothing has changed, so the client can use its cached copy.
+	now = now.Add(time.Hour)
+	resp = get(http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	resp = get(http.Header{"If-Modified-Since": {"Sun, 01 Mar 2026 09:00:00 GMT"}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Once there's a new upstream PAC script, the client has to download the served one again.
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`))
+	resp = get(http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, "Sun, 01 Mar 2026 10:00:00 GMT", resp.Header.Get("Last-Modified"))
+}
+
+func TestWrapPACAddresses(t *testing.T) {
+	interfaces := map[string]string{"172.17.0.1": "docker0", "192.0.2.10": "eth0"}
+	tests := []struct {
+		name      string
+		host      string
+		addresses map[string]string
+		local     string
+		expected  string
+	}{
+		{"Unknown", "", nil, "", "PROXY localhost:1"},
+		{"Loopback", "", nil, "127.0.0.1", "PROXY localhost:1"},
+		{"AllInterfaces", "0.0.0.0", nil, "192.0.2.10", "PROXY 192.0.2.10:1"},
+		{"IPv6", "::", nil, "2001:db8::1", "PROXY [2001:db8::1]:1"},
+		{"ListenAddress", "192.0.2.10", nil, "192.0.2.10", "PROXY 192.0.2.10:1"},
+		{"ByInterface", "", map[string]string{"docker0": "host.docker.internal"}, "172.17.0.1",
+			"PROXY host.docker.internal:1"},
+		{"ByInterfaceWithPort", "", map[string]string{"docker0": "gateway.test:3129"},
+			"172.17.0.1", "PROXY gateway.test:3129"},
+		{"ByIP", "", map[string]string{"192.0.2.10": "alpaca.test"}, "192.0.2.10",
+			"PROXY alpaca.test:1"},
+		{"OtherInterface", "", map[string]string{"docker0": "host.docker.internal"}, "192.0.2.10",
+			"PROXY 192.0.2.10:1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pw := NewPACWrapper(PACData{Host: test.host, Port: 1, Addresses: test.addresses})
+			pw.interfaceName = func(ip net.IP) string { return interfaces[ip.String()] }
+			assert.Equal(t, test.expected, pw.proxy(net.ParseIP(test.local)))
+		})
+	}
+}
+
+func TestPACServeAddress(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234, Addresses: map[string]string{"127.0.0.1": "alpaca.test"}})
+	mux := http.NewServeMux()
+	pw.SetupHandlers(mux)
+	req := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"PROXY alpaca.test:1234"`)
+}
+
+func TestPACDebug(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`))
+	mux := http.NewServeMux()
+	pw.SetupHandlers(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/alpaca.pac?debug&url=http://www.test/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "FindProxyForURL returns: <code>&#34;PROXY localhost:1234&#34;</code>")
+
+	req = httptest.NewRequest(http.MethodGet, "/alpaca.pac?debug", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestPACDebugUsesRunnerSettings(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234})
+	pw.runner = &PACRunner{engine: pacEngines["goja"], timeout: 100 * time.Millisecond}
+	mux := http.NewServeMux()
+	pw.SetupHandlers(mux)
+	tests := []struct {
+		name     string
+		pac      string
+		expected string
+	}{
+		// otto doesn't support arrow functions.
+		{"Engine", `const proxy = () => "PROXY proxy.test:80";
+function FindProxyForURL(url, host) { return proxy(); }`,
+			"FindProxyForURL returns: <code>&#34;PROXY localhost:1234&#34;</code>"},
+		{"Timeout", `function FindProxyForURL(url, host) { while (true) {} }`,
+			"FindProxyForURL returns: <code>error: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pw.Wrap([]byte(test.pac))
+			req := httptest.NewRequest(http.MethodGet, "/alpaca.pac?debug&url=http://www.test/", nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), test.expected)
+		})
+	}
+}
 
-	assert.Equal(t, resp.StatusCode, http.StatusOK)
-	assert.Equal(t, "application/x-ns-proxy-autoconfig", resp.Header.Get("Content-Type"))
-	b, err := io.ReadAll(resp.Body)
-	body := string(b)
+// TestWrapPACCorpus checks that, for each of the PAC files in testdata/pac, the served PAC file
+// sends a request directly whenever alpaca would, and to alpaca otherwise.
+func TestWrapPACCorpus(t *testing.T) {
+	addrs := map[string]string{
+		"intranet.example.com":  "10.1.1.1",
+		"wiki.corp.example.com": "10.1.1.2",
+		"printer":               "192.168.7.7",
+		"router.example.org":    "192.168.1.1",
+		"nas.example.net":       "172.20.0.5",
+		"localhost":             "127.0.0.1",
+		"www.example.com":       "198.51.100.1",
+		"www.test":              "203.0.113.1",
+		"db.internal.test":      "10.200.0.1",
+	}
+	lookupHost := func(host string) ([]string, error) {
+		if addr, ok := addrs[host]; ok {
+			return []string{addr}, nil
+		} else if net.ParseIP(host) != nil {
+			return []string{host}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	urls := []string{
+		"http://printer/status",
+		"http://intranet.example.com/",
+		"https://wiki.corp.example.com/page",
+		"https://www.example.com/",
+		"http://app.vpn.example.com/",
+		"http://10.0.0.1/",
+		"https://192.168.1.1/",
+		"http://localhost:8080/",
+		"http://nas.example.net/",
+		"https://example.net/",
+		"https://www.example.org/",
+		"https://online.bank.example.com/",
+		"http://shop.direct.example.com/",
+		"http://api.broken.example.com/",
+		"http://a.socks-only.example.com/",
+		"http://a.socks-then-direct.example.com/",
+		"http://a.socks-then-proxy.example.com/",
+		"ftp://files.example.com/pub/",
+		"http://db.internal.test/",
+		"https://www.test/",
+		"http://unresolvable.test/",
+	}
+	paths, err := filepath.Glob(filepath.Join("testdata", "pac", "*.pac"))
 	require.NoError(t, err)
-	assert.Contains(t, body, pac)
-	assert.Contains(t, body, `"DIRECT" : "PROXY localhost:1234"`)
-	resp.Body.Close()
+	require.NotEmpty(t, paths)
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		for _, path := range paths {
+			t.Run(filepath.Base(path), func(t *testing.T) {
+				pacjs, err := os.ReadFile(path)
+				require.NoError(t, err)
+				newRunner := func(js []byte) *PACRunner {
+					pr := &PACRunner{
+						engine:      engine,
+						timeout:     5 * time.Second,
+						lookupHost:  lookupHost,
+						myIPAddress: func() string { return "10.9.8.7" },
+					}
+					require.NoError(t, pr.Update(js))
+					return pr
+				}
+				upstream := newRunner(pacjs)
+				pw := NewPACWrapper(PACData{Port: 1})
+				pw.Wrap(pacjs)
+				pac, _, err := pw.pac(nil)
+				require.NoError(t, err)
+				served := newRunner([]byte(pac))
+				for _, rawurl := range urls {
+					u, err := url.Parse(rawurl)
+					require.NoError(t, err)
+					expected := "PROXY localhost:1"
+					result, err := upstream.FindProxyForURL(*u)
+					if entries, _ := parseProxyList(result); err == nil && len(entries) > 0 &&
+						entries[0].proxy == nil {
+						expected = "DIRECT"
+					}
+					actual, err := served.FindProxyForURL(*u)
+					require.NoError(t, err, rawurl)
+					assert.Equal(t, expected, actual, "%s (upstream returned %q)", rawurl, result)
+				}
+			})
+		}
+	})
 }
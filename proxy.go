@@ -16,6 +16,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -27,19 +28,34 @@ import (
 	"strings"
 )
 
-var tlsClientConfig *tls.Config
-
 type ProxyHandler struct {
 	transport *http.Transport
 	auth      *authenticator
 	block     func(string)
+	tls       *proxyTLS
+	// Used for requests to HTTPS servers (which are normally only seen when they've been
+	// decrypted by mitm). Its TLSClientConfig is used to connect to the server.
+	tunnel *http.Transport
+	mitm   *mitm        // If nil, TLS connections are never intercepted
+	rules  *headerRules // If nil, headers aren't rewritten
 }
 
 type proxyFunc func(*http.Request) (*url.URL, error)
 
-func NewProxyHandler(auth *authenticator, proxy proxyFunc, block func(string)) ProxyHandler {
-	tr := &http.Transport{Proxy: proxy, TLSClientConfig: tlsClientConfig}
-	return ProxyHandler{tr, auth, block}
+// NewProxyHandler returns a ProxyHandler that forwards requests to the proxy chosen by the
+// proxy function. If tls is nil, the system's default TLS config is used for HTTPS proxies.
+func NewProxyHandler(auth *authenticator, proxy proxyFunc, block func(string), tls *proxyTLS) ProxyHandler {
+	tr := &http.Transport{Proxy: proxy}
+	if tls != nil {
+		tr.DialTLSContext = tls.dialTLSContext
+	}
+	// Since the tunnel transport doesn't know which proxy each connection goes through, it
+	// can't reuse connections.
+	tunnel := &http.Transport{DisableKeepAlives: true}
+	tunnel.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialTunnel(ctx, addr, auth, tls, tunnel.TLSClientConfig)
+	}
+	return ProxyHandler{transport: tr, auth: auth, block: block, tls: tls, tunnel: tunnel}
 }
 
 func (ph ProxyHandler) WrapHandler(next http.Handler) http.Handler {
@@ -69,22 +85,27 @@ func (ph ProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
+	if ph.mitm.intercepts(req.Host) {
+		ph.mitm.serve(w, req)
+		return
+	}
 	// Establish a connection to the server, or an upstream proxy.
 	id := req.Context().Value(contextKeyID)
-	proxy, err := ph.transport.Proxy(req)
+	proxies, err := ph.proxies(req)
 	if err != nil {
 		log.Printf("[%d] Error finding proxy for request: %v", id, err)
 	}
 	var server net.Conn
-	if proxy == nil {
-		server, err = connectDirect(req)
-	} else {
-		server, err = connectViaProxy(req, proxy, ph.auth)
-		var oe *net.OpError
-		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
-			log.Printf("[%d] Temporarily blocking proxy: %q", id, proxy.Host)
-			ph.block(proxy.Host)
+	for i, proxy := range proxies {
+		if proxy == nil {
+			server, err = connectDirect(req)
+			break
 		}
+		server, err = connectViaProxy(req, proxy, ph.auth, ph.tls)
+		if !isProxyConnectError(err) {
+			break
+		}
+		ph.fallBack(req, proxies, i)
 	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadGateway)
@@ -114,16 +135,7 @@ func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 			client.Close()
 		}
 	}()
-	// Write the response directly to the client connection. If we use Go's ResponseWriter, it
-	// will automatically insert a Content-Length header, which is not allowed in a 2xx CONNECT
-	// response (see https://tools.ietf.org/html/rfc7231#section-4.3.6).
-	var resp []byte
-	if req.ProtoAtLeast(1, 1) {
-		resp = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
-	} else {
-		resp = []byte("HTTP/1.0 200 Connection Established\r\n\r\n")
-	}
-	if _, err := client.Write(resp); err != nil {
+	if _, err := client.Write(connectionEstablished(req)); err != nil {
 		log.Printf("[%d] Error writing response: %v", id, err)
 		return
 	}
@@ -135,6 +147,17 @@ func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 	go func() { _, _ = io.Copy(client, server); client.Close() }()
 }
 
+// connectionEstablished returns the response to a successful CONNECT request. This has to be
+// written directly to the client connection. If we use Go's ResponseWriter, it will
+// automatically insert a Content-Length header, which is not allowed in a 2xx CONNECT response
+// (see https://tools.ietf.org/html/rfc7231#section-4.3.6).
+func connectionEstablished(req *http.Request) []byte {
+	if req.ProtoAtLeast(1, 1) {
+		return []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+	}
+	return []byte("HTTP/1.0 200 Connection Established\r\n\r\n")
+}
+
 func connectDirect(req *http.Request) (net.Conn, error) {
 	server, err := net.Dial("tcp", req.Host)
 	if err != nil {
@@ -144,9 +167,9 @@ func connectDirect(req *http.Request) (net.Conn, error) {
 	return server, err
 }
 
-func connectViaProxy(req *http.Request, proxy *url.URL, auth *authenticator) (net.Conn, error) {
+func connectViaProxy(req *http.Request, proxy *url.URL, auth *authenticator, pt *proxyTLS) (net.Conn, error) {
 	id := req.Context().Value(contextKeyID)
-	var tr transport
+	tr := transport{tls: pt}
 	defer tr.Close()
 	if err := tr.dial(proxy); err != nil {
 		log.Printf("[%d] Error dialling proxy %s: %v", id, proxy.Host, err)
@@ -176,6 +199,45 @@ func connectViaProxy(req *http.Request, proxy *url.URL, auth *authenticator) (ne
 	return tr.hijack(), nil
 }
 
+// dialTunnel connects to an HTTPS server (for the tunnel transport), either directly or through
+// a CONNECT tunnel via the proxy in the request's context.
+func dialTunnel(ctx context.Context, addr string, auth *authenticator, pt *proxyTLS, config *tls.Config) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxy, _ := ctx.Value(contextKeyProxy).(*url.URL); proxy == nil {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		req := &http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: addr},
+			Host:       addr,
+			Header:     http.Header{},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		}
+		conn, err = connectViaProxy(req.WithContext(ctx), proxy, auth, pt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, auth *authenticator) {
 	// Make a copy of the request body, in case we have to replay it (for authentication)
 	var buf bytes.Buffer
@@ -187,21 +249,33 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 		return
 	}
 	rd := bytes.NewReader(buf.Bytes())
-	req.Body = io.NopCloser(rd)
-	resp, err := ph.transport.RoundTrip(req)
+	proxies, err := ph.proxies(req)
 	if err != nil {
-		log.Printf("[%d] Error forwarding request: %v", id, err)
+		log.Printf("[%d] Error finding proxy for request: %v", id, err)
 		w.WriteHeader(http.StatusBadGateway)
-		var oe *net.OpError
-		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
-			proxy, err := ph.transport.Proxy(req)
-			if err != nil {
-				log.Printf("[%d] Proxy connect error to unknown proxy: %v", id, err)
-				return
-			}
-			log.Printf("[%d] Temporarily blocking proxy: %q", id, proxy.Host)
-			ph.block(proxy.Host)
+		return
+	}
+	ph.rules.apply(req, req.Header, false)
+	rt := ph.transport
+	if req.URL.Scheme == "https" {
+		rt = ph.tunnel
+	}
+	var resp *http.Response
+	for i, proxy := range proxies {
+		req = withProxy(req, proxy)
+		if _, err = rd.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+		req.Body = io.NopCloser(rd)
+		resp, err = rt.RoundTrip(req)
+		if proxy == nil || !isProxyConnectError(err) {
+			break
 		}
+		ph.fallBack(req, proxies, i)
+	}
+	if err != nil {
+		log.Printf("[%d] Error forwarding request: %v", id, err)
+		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 	if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
@@ -212,7 +286,7 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 			log.Printf("[%d] Error while seeking to start of request body: %v", id, err)
 		} else {
 			req.Body = io.NopCloser(rd)
-			resp, err = auth.do(req, ph.transport)
+			resp, err = auth.do(req, rt)
 			if err != nil {
 				log.Printf("[%d] Error forwarding request (with auth): %v", id, err)
 				w.WriteHeader(http.StatusBadGateway)
@@ -222,6 +296,7 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 		log.Printf("[%d] Got %q response", id, resp.Status)
 	}
 	defer resp.Body.Close()
+	ph.rules.apply(req, resp.Header, true)
 	copyResponseHeaders(w, resp)
 	w.WriteHeader(resp.StatusCode)
 	_, err = io.Copy(w, resp.Body)
@@ -233,6 +308,44 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 	}
 }
 
+// proxies returns the proxies to try for a request, in order of preference (where nil means
+// that the request should be made directly). These are normally chosen by the ProxyFinder, but
+// if there aren't any, we just use the transport's proxy.
+func (ph ProxyHandler) proxies(req *http.Request) ([]*url.URL, error) {
+	if proxies, ok := req.Context().Value(contextKeyProxies).([]*url.URL); ok {
+		return proxies, nil
+	}
+	proxy, err := ph.transport.Proxy(req)
+	return []*url.URL{proxy}, err
+}
+
+// withProxy returns a copy of the request that the transport will send via the given proxy.
+func withProxy(req *http.Request, proxy *url.URL) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxy))
+}
+
+// fallBack is called when we can't connect to proxies[i]. It blocks the proxy, so that it's
+// skipped for later requests, and logs which proxy (if any) we're going to try next.
+func (ph ProxyHandler) fallBack(req *http.Request, proxies []*url.URL, i int) {
+	id := req.Context().Value(contextKeyID)
+	log.Printf("[%d] Temporarily blocking proxy: %q", id, proxies[i].Host)
+	ph.block(proxies[i].Host)
+	if i+1 == len(proxies) {
+		return
+	} else if next := proxies[i+1]; next == nil {
+		log.Printf("[%d] Retrying %s %s directly", id, req.Method, req.URL)
+	} else {
+		log.Printf("[%d] Retrying %s %s via %q", id, req.Method, req.URL, next.Host)
+	}
+}
+
+// isProxyConnectError reports whether an error was caused by failing to connect to a proxy,
+// rather than by the proxy failing to forward the request.
+func isProxyConnectError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "proxyconnect"
+}
+
 func deleteConnectionTokens(header http.Header) {
 	// Remove any header field(s) with the same name as a connection token (see
 	// https://tools.ietf.org/html/rfc2616#section-14.10)
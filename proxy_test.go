@@ -140,12 +140,12 @@ func TestProxyHTTP2(t *testing.T) {
 }
 
 func newDirectProxy() ProxyHandler {
-	return NewProxyHandler(nil, http.ProxyURL(nil), func(string) {})
+	return NewProxyHandler(nil, http.ProxyURL(nil), func(string) {}, nil)
 }
 
 func newChildProxy(parent *httptest.Server) http.Handler {
 	parentURL := &url.URL{Host: parent.Listener.Addr().String()}
-	childProxy := NewProxyHandler(nil, getProxyFromContext, func(string) {})
+	childProxy := NewProxyHandler(nil, getProxyFromContext, func(string) {}, nil)
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := context.WithValue(req.Context(), contextKeyProxy, parentURL)
 		reqWithProxy := req.WithContext(ctx)
@@ -374,3 +374,59 @@ func TestTransportReturnsProxyConnectOpError(t *testing.T) {
 	oe := err.(*net.OpError)
 	assert.Equal(t, "proxyconnect", oe.Op)
 }
+
+func TestFallBackToNextProxy(t *testing.T) {
+	var r requestLogger
+	server := httptest.NewServer(r.log("server", http.NewServeMux()))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(r.log("tlsServer", http.NewServeMux()))
+	defer tlsServer.Close()
+	parentProxy := httptest.NewServer(r.log("parentProxy", newDirectProxy()))
+	defer parentProxy.Close()
+	parentURL := &url.URL{Host: parentProxy.Listener.Addr().String()}
+	// Find an address that nothing is listening on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadURL := &url.URL{Host: l.Addr().String()}
+	l.Close()
+
+	for _, test := range []struct {
+		name     string
+		proxies  []*url.URL
+		server   *httptest.Server
+		requests []string
+	}{
+		{"NextProxy", []*url.URL{deadURL, parentURL}, server,
+			[]string{"GET to parentProxy", "GET to server"}},
+		{"NextProxyForConnect", []*url.URL{deadURL, parentURL}, tlsServer,
+			[]string{"CONNECT to parentProxy", "GET to tlsServer"}},
+		{"Direct", []*url.URL{deadURL, nil}, server, []string{"GET to server"}},
+		{"DirectForConnect", []*url.URL{deadURL, nil}, tlsServer,
+			[]string{"GET to tlsServer"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r.clear()
+			var blocked []string
+			ph := NewProxyHandler(nil, getProxyFromContext,
+				func(proxy string) { blocked = append(blocked, proxy) }, nil)
+			proxy := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, req *http.Request) {
+					ctx := context.WithValue(req.Context(), contextKeyProxies, test.proxies)
+					ctx = context.WithValue(ctx, contextKeyProxy, test.proxies[0])
+					ph.ServeHTTP(w, req.WithContext(ctx))
+				}))
+			defer proxy.Close()
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy:           proxyServer(t, proxy),
+					TLSClientConfig: tlsConfig(tlsServer),
+				},
+			}
+			resp, err := client.Get(test.server.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.requests, r.requests)
+			assert.Equal(t, []string{deadURL.Host}, blocked)
+		})
+	}
+}
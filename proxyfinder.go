@@ -17,16 +17,22 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 const contextKeyProxy = contextKey("proxy")
 
+// The proxies to try for a request, in order. The ProxyHandler falls back to the next one
+// (updating contextKeyProxy) if it can't connect to a proxy.
+const contextKeyProxies = contextKey("proxies")
+
 func getProxyFromContext(req *http.Request) (*url.URL, error) {
 	if value := req.Context().Value(contextKeyProxy); value != nil {
 		proxy := value.(*url.URL)
@@ -38,71 +44,255 @@ func getProxyFromContext(req *http.Request) (*url.URL, error) {
 type ProxyFinder struct {
 	runner  *PACRunner
 	fetcher *pacFetcher
+	checker *connectivityChecker
+	health  *healthChecker // nil if health checks are disabled
+	proxies []*url.URL     // The proxies that appear in the current PAC script
 	wrapper *PACWrapper
 	blocked *blocklist
 	sync.Mutex
 }
 
-func NewProxyFinder(pacurl string, wrapper *PACWrapper) *ProxyFinder {
+// NewProxyFinder returns a ProxyFinder that uses the PAC script downloaded by the fetcher. If
+// checker is nil, we're online whenever the PAC script can be downloaded.
+func NewProxyFinder(fetcher *pacFetcher, checker *connectivityChecker, wrapper *PACWrapper, runner *PACRunner) *ProxyFinder {
+	if checker == nil {
+		checker, _ = newConnectivityChecker(connectivityPAC, url.URL{}, 0, runner, nil)
+	}
 	pf := &ProxyFinder{wrapper: wrapper, blocked: newBlocklist()}
-	pf.runner = new(PACRunner)
-	pf.fetcher = newPACFetcher(pacurl)
+	pf.runner = runner
+	pf.fetcher = fetcher
+	pf.checker = checker
+	pf.fetcher.netChanged = func() {
+		pf.runner.networkChanged()
+		pf.checker.changed()
+	}
+	pf.fetcher.onFileChange = pf.checkForUpdates
+	pf.wrapper.online = pf.checker.isOnline
 	pf.checkForUpdates()
+	pf.checker.start()
 	return pf
 }
 
 func (pf *ProxyFinder) WrapHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		pf.checkForUpdates()
-		proxy, err := pf.findProxyForRequest(req)
+		proxies, err := pf.findProxiesForRequest(req)
 		if err != nil {
 			log.Printf("[%d] %v", req.Context().Value(contextKeyID), err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if proxy != nil {
-			ctx := context.WithValue(req.Context(), contextKeyProxy, proxy)
-			req = req.WithContext(ctx)
+		ctx := context.WithValue(req.Context(), contextKeyProxies, proxies)
+		if proxies[0] != nil {
+			ctx = context.WithValue(ctx, contextKeyProxy, proxies[0])
 		}
+		req = req.WithContext(ctx)
 		next.ServeHTTP(w, req)
 	})
 }
 
+func (pf *ProxyFinder) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/pac/trace", pf.handleTrace)
+	mux.HandleFunc("/blocklist", pf.handleBlocklist)
+}
+
+// handleBlocklist lets the user inspect and change the blocklist of a running instance (see
+// blockCommand). GET lists the blocked proxies, POST blocks the proxy given in the "proxy"
+// query parameter (for the "duration" parameter, if given), and DELETE unblocks it. Like
+// handleTrace, it's only available to clients connecting from a loopback address.
+func (pf *ProxyFinder) handleBlocklist(w http.ResponseWriter, req *http.Request) {
+	if !isLoopback(req.RemoteAddr) || isFromWebPage(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query := req.URL.Query()
+	proxy := query.Get("proxy")
+	if req.Method != http.MethodGet {
+		if _, _, err := net.SplitHostPort(proxy); err != nil {
+			http.Error(w, "expected host:port in the proxy parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var d time.Duration
+		if value := query.Get("duration"); value != "" {
+			var err error
+			if d, err = time.ParseDuration(value); err != nil || d < 0 {
+				http.Error(w, "invalid duration: "+value, http.StatusBadRequest)
+				return
+			}
+		}
+		log.Printf("Blocking proxy %s by hand", proxy)
+		pf.blocked.block(proxy, d)
+	case http.MethodDelete:
+		if !pf.blocked.unblock(proxy) {
+			http.Error(w, "proxy isn't blocked: "+proxy, http.StatusNotFound)
+			return
+		}
+		log.Printf("Unblocking proxy %s by hand", proxy)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, pf.blocked.String()); err != nil {
+		log.Printf("Error writing blocklist to response: %v", err)
+	}
+}
+
+// isFromWebPage reports whether a request was made by a web page in a browser. Loopback
+// clients aren't necessarily trusted, since any page open on this machine can send a simple
+// cross-origin POST to localhost. Browsers identify such requests with the Origin or
+// Sec-Fetch-Site headers, which alpaca block never sets.
+func isFromWebPage(req *http.Request) bool {
+	if req.Header.Get("Origin") != "" {
+		return true
+	}
+	site := req.Header.Get("Sec-Fetch-Site")
+	return site != "" && site != "none"
+}
+
+// handleTrace evaluates the PAC script for the URL in the "url" query parameter, and responds
+// with a trace of the helper functions called by the script. Since this can trigger DNS
+// lookups and reveals details of the network configuration, it's only available to clients
+// connecting from a loopback address.
+func (pf *ProxyFinder) handleTrace(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if !isLoopback(req.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	u, err := url.Parse(req.URL.Query().Get("url"))
+	if err != nil || u.Host == "" {
+		http.Error(w, "expected an absolute URL in the url parameter", http.StatusBadRequest)
+		return
+	} else if !pf.runner.loaded() {
+		http.Error(w, "no PAC script has been loaded", http.StatusServiceUnavailable)
+		return
+	}
+	trace := pf.runner.Trace(*u)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.WriteString(w, trace.String()); err != nil {
+		log.Printf("Error writing PAC trace to response: %v", err)
+	}
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func (pf *ProxyFinder) checkForUpdates() {
 	pf.Lock()
 	defer pf.Unlock()
 	pacjs := pf.fetcher.download()
+	pf.checker.pacDownloaded(pf.fetcher.isConnected())
 	if pacjs == nil {
 		if !pf.fetcher.isConnected() {
-			pf.blocked = newBlocklist()
 			pf.wrapper.Wrap(nil)
 		}
 		return
 	}
-	pf.blocked = newBlocklist()
-	if err := pf.runner.Update(pacjs); err != nil {
+	if err := pf.runner.Update(pacjs); err != nil && pf.runner.loaded() {
+		log.Printf("Error running PAC JS, still using the previous PAC JS: %q", err)
+	} else if err != nil {
 		log.Printf("Error running PAC JS: %q", err)
 	} else {
 		pf.wrapper.Wrap(pacjs)
+		pf.checker.changed()
+		pf.proxies = proxiesInPAC(pacjs)
+		// Stop checking proxies that are no longer used before forgetting about them, so
+		// that a check in progress can't block them again.
+		if pf.health != nil {
+			pf.health.setProxies(pf.proxies)
+		}
+		pf.blocked.retain(pf.inPAC)
 	}
 }
 
-func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error) {
+// findProxiesForRequest returns the proxies to try for a request, in order of preference (nil
+// means that the request should be made directly). Blocked proxies are moved to the end of the
+// list, so that they're only tried as a last resort.
+func (pf *ProxyFinder) findProxiesForRequest(req *http.Request) ([]*url.URL, error) {
 	id := req.Context().Value(contextKeyID)
 	if pf.fetcher == nil {
 		log.Printf(`[%d] %s %s via "DIRECT"`, id, req.Method, req.URL)
-		return nil, nil
+		return []*url.URL{nil}, nil
 	}
-	if !pf.fetcher.isConnected() {
-		log.Printf(`[%d] %s %s via "DIRECT" (not connected to PAC server)`,
-			id, req.Method, req.URL)
-		return nil, nil
+	if !pf.checker.isOnline() {
+		log.Printf(`[%d] %s %s via "DIRECT" (offline)`, id, req.Method, req.URL)
+		return []*url.URL{nil}, nil
 	}
 	str, err := pf.runner.FindProxyForURL(*req.URL)
 	if err != nil {
 		return nil, err
 	}
-	var fallback *url.URL
+	entries, invalid := parseProxyList(str)
+	for _, elem := range invalid {
+		log.Printf("[%d] Couldn't parse proxy: %q", id, elem)
+	}
+	var proxies, blocked []*url.URL
+	for _, entry := range entries {
+		if entry.proxy != nil && pf.blocked.contains(entry.proxy.Host) {
+			blocked = append(blocked, entry.proxy)
+			continue
+		}
+		if len(proxies) == 0 {
+			log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, entry.text)
+		}
+		proxies = append(proxies, entry.proxy)
+		if entry.proxy == nil {
+			// Since we don't fall back from a direct connection, there's no point in
+			// looking any further.
+			blocked = nil
+			break
+		}
+	}
+	if len(proxies) == 0 && len(blocked) > 0 {
+		// All the proxies are currently blocked. In this case, we'll temporarily ignore the
+		// blocklist and try them anyway.
+		log.Printf("[%d] %s %s via %q (all proxies are blocked)",
+			id, req.Method, req.URL, "PROXY "+blocked[0].Host)
+	}
+	proxies = append(proxies, blocked...)
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxies available")
+	}
+	if pf.health != nil {
+		for _, proxy := range proxies {
+			if proxy != nil {
+				pf.health.observe(proxy)
+			}
+		}
+	}
+	return proxies, nil
+}
+
+// proxyEntry is a single element of the string returned by FindProxyForURL.
+type proxyEntry struct {
+	text  string   // The entry as it appeared in the PAC result, e.g. "PROXY proxy.test:80"
+	proxy *url.URL // The proxy to use, or nil for DIRECT
+}
+
+func (e proxyEntry) String() string {
+	if e.proxy == nil {
+		return "DIRECT"
+	}
+	return e.proxy.String()
+}
+
+// parseProxyList parses the result of FindProxyForURL into a list of entries, in order of
+// preference. Any entries that can't be parsed (or that use an unsupported proxy type, such
+// as SOCKS) are skipped, and returned separately.
+func parseProxyList(str string) (entries []proxyEntry, invalid []string) {
 	for _, elem := range strings.Split(str, ";") {
 		fields := strings.Fields(strings.TrimSpace(elem))
 		var scheme string
@@ -110,39 +300,55 @@ func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error)
 		if len(fields) == 0 {
 			continue
 		} else if fields[0] == "DIRECT" {
-			log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, elem)
-			return nil, nil
-		} else if fields[0] == "PROXY" || fields[0] == "HTTP" {
+			entries = append(entries, proxyEntry{text: elem})
+			continue
+		} else if (fields[0] == "PROXY" || fields[0] == "HTTP") && len(fields) == 2 {
 			scheme = "http"
 			defaultPort = "80"
-		} else if fields[0] == "HTTPS" {
+		} else if fields[0] == "HTTPS" && len(fields) == 2 {
 			scheme = "https"
 			defaultPort = "443"
 		} else {
-			log.Printf("[%d] Couldn't parse proxy: %q", id, elem)
+			invalid = append(invalid, elem)
 			continue
 		}
 		proxy := &url.URL{Scheme: scheme, Host: fields[1]}
 		if proxy.Port() == "" {
 			proxy.Host = net.JoinHostPort(proxy.Host, defaultPort)
 		}
-		if pf.blocked.contains(proxy.Host) {
-			if fallback == nil {
-				fallback = proxy
-			}
-			continue
-		}
-		log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, elem)
-		return proxy, nil
+		entries = append(entries, proxyEntry{text: elem, proxy: proxy})
 	}
-	if fallback != nil {
-		// All the proxies are currently blocked. In this case, we'll temporarily ignore the
-		// blocklist and fall back to the first proxy that we saw (and skipped).
-		return fallback, nil
+	return entries, invalid
+}
+
+// inPAC reports whether a proxy (given as host:port) appears in the current PAC script. It
+// must be called with the lock held.
+func (pf *ProxyFinder) inPAC(host string) bool {
+	for _, proxy := range pf.proxies {
+		if proxy.Host == host {
+			return true
+		}
 	}
-	return nil, errors.New("no proxies available")
+	return false
 }
 
 func (pf *ProxyFinder) blockProxy(proxy string) {
 	pf.blocked.add(proxy)
 }
+
+func (pf *ProxyFinder) unblockProxy(proxy string) {
+	pf.blocked.remove(proxy)
+}
+
+// startHealthChecks starts checking the health of the proxies used by the current PAC script in
+// the background. Proxies that fail are blocked, and proxies that recover are unblocked.
+func (pf *ProxyFinder) startHealthChecks(hc *healthChecker) {
+	pf.Lock()
+	defer pf.Unlock()
+	pf.health = hc
+	hc.active = pf.checker.isOnline
+	hc.block = pf.blockProxy
+	hc.unblock = pf.unblockProxy
+	hc.setProxies(pf.proxies)
+	hc.start()
+}
@@ -17,8 +17,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -50,22 +52,23 @@ func TestFindProxyForRequest(t *testing.T) {
 			server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
 			defer server.Close()
 			pw := NewPACWrapper(PACData{Port: 1})
-			pf := NewProxyFinder(server.URL, pw)
+			pf := NewProxyFinder(newPACFetcher(server.URL), nil, pw, new(PACRunner))
 			req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
 			ctx := context.WithValue(req.Context(), contextKeyID, i)
 			req = req.WithContext(ctx)
-			proxy, err := pf.findProxyForRequest(req)
+			proxies, err := pf.findProxiesForRequest(req)
 			if test.expectError {
 				assert.NotNil(t, err)
 				return
 			}
 			require.NoError(t, err)
+			require.NotEmpty(t, proxies)
 			if test.expected == "" {
-				assert.Nil(t, proxy)
+				assert.Nil(t, proxies[0])
 				return
 			}
-			require.NotNil(t, proxy)
-			assert.Equal(t, test.expected, proxy.Host)
+			require.NotNil(t, proxies[0])
+			assert.Equal(t, test.expected, proxies[0].Host)
 		})
 	}
 }
@@ -73,11 +76,12 @@ func TestFindProxyForRequest(t *testing.T) {
 func TestFallbackToDirectWhenNotConnected(t *testing.T) {
 	url := "http://pacserver.invalid/nonexistent.pac"
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(url, pw)
+	pf := NewProxyFinder(newPACFetcher(url), nil, pw, new(PACRunner))
 	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
-	proxy, err := pf.findProxyForRequest(req)
+	proxies, err := pf.findProxiesForRequest(req)
 	require.NoError(t, err)
-	assert.Nil(t, proxy)
+	require.Len(t, proxies, 1)
+	assert.Nil(t, proxies[0])
 }
 
 // Removed TestFallbackToDirectWhenNoPACURL - behaviour is fallback to system default when no PACURL, test case TestFallbackToDefaultWhenNoPACUrl
@@ -87,19 +91,169 @@ func TestSkipBadProxies(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
 	defer server.Close()
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(server.URL, pw)
+	pf := NewProxyFinder(newPACFetcher(server.URL), nil, pw, new(PACRunner))
 	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
 	ctx := context.WithValue(req.Context(), contextKeyID, 0)
 	req = req.WithContext(ctx)
-	proxy, err := pf.findProxyForRequest(req)
+	hosts := func() []string {
+		proxies, err := pf.findProxiesForRequest(req)
+		require.NoError(t, err)
+		var hosts []string
+		for _, proxy := range proxies {
+			hosts = append(hosts, proxy.Host)
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"primary:80", "backup:80"}, hosts())
+	// Blocked proxies are only tried as a last resort.
+	pf.blocked.add("primary:80")
+	assert.Equal(t, []string{"backup:80", "primary:80"}, hosts())
+	pf.blocked.add("backup:80")
+	assert.Equal(t, []string{"primary:80", "backup:80"}, hosts())
+}
+
+func TestSkipBadProxiesBeforeDirect(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY primary:80; DIRECT; PROXY backup:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pf := NewProxyFinder(newPACFetcher(server.URL), nil, NewPACWrapper(PACData{Port: 1}), new(PACRunner))
+	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
+	proxies, err := pf.findProxiesForRequest(req)
 	require.NoError(t, err)
-	assert.Equal(t, "primary:80", proxy.Host)
+	require.Len(t, proxies, 2)
+	assert.Equal(t, "primary:80", proxies[0].Host)
+	assert.Nil(t, proxies[1])
+	// Once the first proxy is blocked, we go directly (and there's no point in trying any
+	// proxies after that).
 	pf.blocked.add("primary:80")
-	proxy, err = pf.findProxyForRequest(req)
+	proxies, err = pf.findProxiesForRequest(req)
 	require.NoError(t, err)
-	assert.Equal(t, "backup:80", proxy.Host)
+	assert.Equal(t, []*url.URL{nil}, proxies)
+}
+
+func TestTraceHandler(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return shExpMatch(host, "*.test") ? "DIRECT" : "PROXY proxy.test:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pf := NewProxyFinder(newPACFetcher(server.URL), nil, NewPACWrapper(PACData{Port: 1}), new(PACRunner))
+	mux := http.NewServeMux()
+	pf.SetupHandlers(mux)
+	tests := []struct {
+		name       string
+		remoteAddr string
+		target     string
+		status     int
+		body       string
+	}{
+		{"Loopback", "127.0.0.1:1234", "/pac/trace?url=http://www.test/", http.StatusOK,
+			`shExpMatch("www.test", "*.test") = true` + "\n" +
+				`FindProxyForURL("http://www.test/", "www.test") = "DIRECT"` + "\n"},
+		{"IPv6Loopback", "[::1]:1234", "/pac/trace?url=http://www.test/", http.StatusOK, ""},
+		{"NotLoopback", "192.0.2.1:1234", "/pac/trace?url=http://www.test/",
+			http.StatusForbidden, ""},
+		{"MissingURL", "127.0.0.1:1234", "/pac/trace", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			req.RemoteAddr = test.remoteAddr
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			resp := w.Result()
+			assert.Equal(t, test.status, resp.StatusCode)
+			if test.body != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, test.body, string(body))
+			}
+		})
+	}
+}
+
+func TestBlocklistKeptAcrossReloads(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY primary:80; PROXY backup:80" }`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, js)
+	}))
+	defer server.Close()
+	nm := &fakeNetMonitor{}
+	fetcher := newPACFetcher(server.URL)
+	fetcher.monitor = nm
+	pf := NewProxyFinder(fetcher, nil, NewPACWrapper(PACData{Port: 1}), new(PACRunner))
+	pf.blocked.add("primary:80")
 	pf.blocked.add("backup:80")
-	proxy, err = pf.findProxyForRequest(req)
-	require.NoError(t, err)
-	assert.Equal(t, "primary:80", proxy.Host)
+	// Proxies that are still in the new PAC script stay blocked, and others are forgotten.
+	js = `function FindProxyForURL(url, host) { return "PROXY primary:80; PROXY other:80" }`
+	nm.changed = true
+	pf.checkForUpdates()
+	assert.True(t, pf.blocked.contains("primary:80"))
+	assert.False(t, pf.blocked.contains("backup:80"))
+}
+
+func TestBlocklistHandler(t *testing.T) {
+	pf := NewProxyFinder(newPACFetcher("http://pacserver.invalid/nonexistent.pac"), nil,
+		NewPACWrapper(PACData{Port: 1}), new(PACRunner))
+	mux := http.NewServeMux()
+	pf.SetupHandlers(mux)
+	tests := []struct {
+		name       string
+		method     string
+		remoteAddr string
+		target     string
+		status     int
+		body       string
+	}{
+		{"Block", http.MethodPost, "127.0.0.1:1234", "/blocklist?proxy=foo:80",
+			http.StatusOK, "foo:80 blocked by hand\n"},
+		{"List", http.MethodGet, "127.0.0.1:1234", "/blocklist", http.StatusOK,
+			"foo:80 blocked by hand\n"},
+		{"NotLoopback", http.MethodGet, "192.0.2.1:1234", "/blocklist",
+			http.StatusForbidden, ""},
+		{"InvalidProxy", http.MethodPost, "127.0.0.1:1234", "/blocklist?proxy=foo",
+			http.StatusBadRequest, "expected host:port in the proxy parameter\n"},
+		{"InvalidDuration", http.MethodPost, "127.0.0.1:1234",
+			"/blocklist?proxy=foo:80&duration=soon", http.StatusBadRequest,
+			"invalid duration: soon\n"},
+		{"Unblock", http.MethodDelete, "127.0.0.1:1234", "/blocklist?proxy=foo:80",
+			http.StatusOK, ""},
+		{"NotBlocked", http.MethodDelete, "127.0.0.1:1234", "/blocklist?proxy=foo:80",
+			http.StatusNotFound, "proxy isn't blocked: foo:80\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, nil)
+			req.RemoteAddr = test.remoteAddr
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			assert.Equal(t, test.status, w.Code)
+			assert.Equal(t, test.body, w.Body.String())
+		})
+	}
+}
+
+func TestBlocklistHandlerRejectsWebPages(t *testing.T) {
+	pf := NewProxyFinder(newPACFetcher("http://pacserver.invalid/nonexistent.pac"), nil,
+		NewPACWrapper(PACData{Port: 1}), new(PACRunner))
+	mux := http.NewServeMux()
+	pf.SetupHandlers(mux)
+	tests := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{"Origin", "Origin", "http://attacker.test"},
+		{"CrossSite", "Sec-Fetch-Site", "cross-site"},
+		{"SameSite", "Sec-Fetch-Site", "same-site"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/blocklist?proxy=foo:80", nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set(test.header, test.value)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+	assert.False(t, pf.blocked.contains("foo:80"))
 }
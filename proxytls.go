@@ -0,0 +1,193 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// proxyTLS is the TLS configuration used to connect to HTTPS proxies (i.e. proxies given as
+// "HTTPS host:port" in the PAC script). The CA bundles and client certificate are read from
+// files, and are reloaded whenever the files change. A nil *proxyTLS uses the system's CAs and
+// no client certificate.
+type proxyTLS struct {
+	caFiles     []string
+	certFile    string
+	keyFile     string
+	serverNames map[string]string // Server name to send (and verify) for each proxy host
+	pins        [][]byte          // SHA-256 hashes of public keys that a proxy must present
+	roots       atomic.Pointer[x509.CertPool]
+	cert        atomic.Pointer[tls.Certificate]
+	watchers    []*fileWatcher
+}
+
+// newProxyTLS loads the given CA bundles (which replace the system's CAs, if any are given)
+// and client certificate. Each pin is the base64-encoded SHA-256 hash of a public key, in the
+// same format as curl's --pinnedpubkey (e.g. "sha256//YhKJKSzoTt2b5FP18fvpHo7fJYqQCjAa3HWY3tvRMwE=").
+func newProxyTLS(caFiles []string, certFile, keyFile string, serverNames map[string]string, pins []string) (*proxyTLS, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate and key must be given together")
+	}
+	pt := &proxyTLS{
+		caFiles:     caFiles,
+		certFile:    certFile,
+		keyFile:     keyFile,
+		serverNames: serverNames,
+	}
+	for _, pin := range pins {
+		hash, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		pt.pins = append(pt.pins, hash)
+	}
+	if err := pt.load(); err != nil {
+		return nil, err
+	}
+	return pt, nil
+}
+
+func parsePin(pin string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(pin, "sha256//")
+	if !ok {
+		return nil, fmt.Errorf("invalid pin %q: expected sha256//<base64>", pin)
+	}
+	hash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: expected a base64-encoded SHA-256 hash", pin)
+	}
+	return hash, nil
+}
+
+// load reads the CA bundles and client certificate. If any of them can't be read, the current
+// configuration is left alone.
+func (pt *proxyTLS) load() error {
+	var roots *x509.CertPool
+	if len(pt.caFiles) > 0 {
+		roots = x509.NewCertPool()
+		for _, path := range pt.caFiles {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			} else if !roots.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", path)
+			}
+		}
+	}
+	var cert *tls.Certificate
+	if pt.certFile != "" {
+		c, err := tls.LoadX509KeyPair(pt.certFile, pt.keyFile)
+		if err != nil {
+			return fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cert = &c
+	}
+	pt.roots.Store(roots)
+	pt.cert.Store(cert)
+	return nil
+}
+
+// watch reloads the configuration whenever one of its files changes.
+func (pt *proxyTLS) watch() {
+	paths := append([]string{}, pt.caFiles...)
+	if pt.certFile != "" {
+		paths = append(paths, pt.certFile, pt.keyFile)
+	}
+	for _, path := range paths {
+		pt.watchers = append(pt.watchers, newFileWatcher(path, pt.reload))
+	}
+}
+
+func (pt *proxyTLS) reload() {
+	if err := pt.load(); err != nil {
+		log.Printf("Error reloading TLS config for HTTPS proxies, still using the previous config: %v", err)
+		return
+	}
+	log.Printf("Reloaded TLS config for HTTPS proxies")
+}
+
+func (pt *proxyTLS) close() {
+	for _, w := range pt.watchers {
+		w.close()
+	}
+}
+
+// config returns the TLS config for connecting to the proxy at addr (a host:port pair).
+func (pt *proxyTLS) config(addr string) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if pt == nil {
+		return &tls.Config{ServerName: host}
+	}
+	config := &tls.Config{ServerName: host, RootCAs: pt.roots.Load()}
+	if name, ok := pt.serverNames[host]; ok {
+		config.ServerName = name
+	}
+	if cert := pt.cert.Load(); cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	if len(pt.pins) > 0 {
+		config.VerifyConnection = pt.checkPins
+	}
+	return config
+}
+
+// checkPins checks that one of the certificates in the proxy's (verified) certificate chain
+// has a pinned public key.
+func (pt *proxyTLS) checkPins(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pt.pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("no public key presented by %s matches a pinned key", cs.ServerName)
+}
+
+// dial connects to an HTTPS proxy.
+func (pt *proxyTLS) dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := tls.Dialer{Config: pt.config(addr)}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// dialTLSContext is used as the DialTLSContext function of an http.Transport. This is called
+// both for HTTPS proxies and for HTTPS servers that are connected to directly, so we use the
+// proxy in the request's context to tell them apart.
+func (pt *proxyTLS) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxy, _ := ctx.Value(contextKeyProxy).(*url.URL); proxy != nil && proxy.Host == addr {
+		return pt.dial(ctx, addr)
+	}
+	dialer := tls.Dialer{}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,270 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert, key}
+}
+
+// issue returns a certificate signed by the CA, for the given DNS names and IP addresses (or
+// for client authentication, if there aren't any).
+func (ca *testCA) issue(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "Test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+func pinFor(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// newHTTPSProxy starts a proxy that only accepts TLS connections, using the given certificate.
+// If clientCAs is non-nil, clients must present a certificate signed by one of them.
+func newHTTPSProxy(t *testing.T, cert tls.Certificate, clientCAs *x509.CertPool) *url.URL {
+	server := httptest.NewUnstartedServer(newDirectProxy())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = clientCAs
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return &url.URL{Scheme: "https", Host: server.Listener.Addr().String()}
+}
+
+func TestProxyTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	caFile := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+	otherCAFile := writePEM(t, filepath.Join(dir, "other.pem"), "CERTIFICATE", otherCA.cert.Raw)
+	client := ca.issue(t)
+	certFile := writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", client.Certificate[0])
+	der, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	require.NoError(t, err)
+	keyFile := writePEM(t, filepath.Join(dir, "client.key"), "PRIVATE KEY", der)
+
+	serverCert := ca.issue(t, "127.0.0.1")
+	proxy := newHTTPSProxy(t, serverCert, nil)
+	mtlsProxy := newHTTPSProxy(t, serverCert, ca.pool())
+	namedProxy := newHTTPSProxy(t, ca.issue(t, "proxy.test"), nil)
+
+	tests := []struct {
+		name        string
+		proxy       *url.URL
+		caFiles     []string
+		client      bool
+		serverNames map[string]string
+		pins        []string
+		ok          bool
+	}{
+		{"UntrustedCA", proxy, nil, false, nil, nil, false},
+		{"TrustedCA", proxy, []string{otherCAFile, caFile}, false, nil, nil, true},
+		{"WrongCA", proxy, []string{otherCAFile}, false, nil, nil, false},
+		{"ClientCert", mtlsProxy, []string{caFile}, true, nil, nil, true},
+		{"NoClientCert", mtlsProxy, []string{caFile}, false, nil, nil, false},
+		{"ServerName", namedProxy, []string{caFile}, false,
+			map[string]string{"127.0.0.1": "proxy.test"}, nil, true},
+		{"WrongServerName", namedProxy, []string{caFile}, false, nil, nil, false},
+		{"PinnedLeaf", proxy, []string{caFile}, false, nil,
+			[]string{pinFor(serverCert.Leaf)}, true},
+		{"PinnedCA", proxy, []string{caFile}, false, nil,
+			[]string{pinFor(otherCA.cert), pinFor(ca.cert)}, true},
+		{"WrongPin", proxy, []string{caFile}, false, nil, []string{pinFor(otherCA.cert)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cert, key string
+			if test.client {
+				cert, key = certFile, keyFile
+			}
+			pt, err := newProxyTLS(test.caFiles, cert, key, test.serverNames, test.pins)
+			require.NoError(t, err)
+			tr := transport{tls: pt}
+			defer tr.Close()
+			err = tr.dial(test.proxy)
+			if err == nil {
+				// With TLS 1.3, a missing client certificate is only reported after
+				// the handshake, so make sure that the proxy responds to a request.
+				var resp *http.Response
+				req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+				if resp, err = tr.RoundTrip(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+			if test.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestProxyTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", newTestCA(t).cert.Raw)
+	proxy := newHTTPSProxy(t, ca.issue(t, "127.0.0.1"), nil)
+	pt, err := newProxyTLS([]string{caFile}, "", "", nil, nil)
+	require.NoError(t, err)
+	conn, err := pt.dial(context.Background(), proxy.Host)
+	require.Error(t, err)
+	// A file that can't be loaded is ignored, and the previous config is kept.
+	require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0600))
+	pt.reload()
+	assert.NotNil(t, pt.roots.Load())
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	pt.reload()
+	conn, err = pt.dial(context.Background(), proxy.Host)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestProxyTLSForRequests(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+	proxy := newHTTPSProxy(t, ca.issue(t, "127.0.0.1"), nil)
+	pt, err := newProxyTLS([]string{caFile}, "", "", nil, nil)
+	require.NoError(t, err)
+	var r requestLogger
+	server := httptest.NewServer(r.log("server", http.NewServeMux()))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(r.log("tlsServer", http.NewServeMux()))
+	defer tlsServer.Close()
+	ph := NewProxyHandler(nil, getProxyFromContext, func(string) {}, pt)
+	alpaca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ph.ServeHTTP(w, withProxy(req, proxy))
+	}))
+	defer alpaca.Close()
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           proxyServer(t, alpaca),
+			TLSClientConfig: tlsConfig(tlsServer),
+		},
+	}
+	for _, u := range []string{server.URL, tlsServer.URL} {
+		resp, err := client.Get(u)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, []string{"GET to server", "GET to tlsServer"}, r.requests)
+}
+
+func TestParsePin(t *testing.T) {
+	_, err := parsePin("sha256//" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	assert.NoError(t, err)
+	for _, pin := range []string{"", "md5//AAAA", "sha256//AAAA", "sha256//not base64"} {
+		_, err := parsePin(pin)
+		assert.Error(t, err, pin)
+	}
+}
+
+func TestProxyTLSForConnectivityCheck(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+	proxy := newHTTPSProxy(t, ca.issue(t, "127.0.0.1"), nil)
+	server := httptest.NewServer(http.NewServeMux())
+	defer server.Close()
+	pt, err := newProxyTLS([]string{caFile}, "", "", nil, nil)
+	require.NoError(t, err)
+	// Without the proxy's CA, the probe fails.
+	c, err := newConnectivityChecker(connectivityURL, url.URL{}, 0, new(PACRunner), nil)
+	require.NoError(t, err)
+	assert.Error(t, c.getViaProxy(proxy, server.URL, time.Second))
+	c, err = newConnectivityChecker(connectivityURL, url.URL{}, 0, new(PACRunner), pt)
+	require.NoError(t, err)
+	assert.NoError(t, c.getViaProxy(proxy, server.URL, time.Second))
+}
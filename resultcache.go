@@ -0,0 +1,97 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// The maximum number of results to keep in a resultCache.
+const maxCachedResults = 1000
+
+// resultCache is an LRU cache of the strings returned by FindProxyForURL. PACRunner keys it by
+// the scheme, host and port of the URL, since that's all that most PAC scripts look at, so that
+// requests to the same server share a cache entry. If the script reads its url argument (see
+// usesURL), the result could depend on the path or query too, so the whole URL is used instead
+// (although https:// URLs are still stripped down to the scheme, host and port, since that's all
+// that the script sees).
+type resultCache struct {
+	ttl      time.Duration
+	capacity int
+	now      func() time.Time
+	lru      *list.List // Entries, ordered from most to least recently used
+	entries  map[string]*list.Element
+	mux      sync.Mutex
+}
+
+type resultCacheEntry struct {
+	key    string
+	result string
+	expiry time.Time
+}
+
+func newResultCache(ttl time.Duration, capacity int) *resultCache {
+	return &resultCache{
+		ttl:      ttl,
+		capacity: capacity,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *resultCache) get(key string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*resultCacheEntry)
+	if !c.now().Before(entry.expiry) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.result, true
+}
+
+func (c *resultCache) add(key, result string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	expiry := c.now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*resultCacheEntry)
+		entry.result, entry.expiry = result, expiry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&resultCacheEntry{key, result, expiry})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+func (c *resultCache) flush() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+}
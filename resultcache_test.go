@@ -0,0 +1,143 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultCacheExpiry(t *testing.T) {
+	c := newResultCache(10*time.Second, 10)
+	var now time.Time
+	c.now = func() time.Time { return now }
+	c.add("http://www.test/", "DIRECT")
+	now = now.Add(9 * time.Second)
+	result, ok := c.get("http://www.test/")
+	assert.True(t, ok)
+	assert.Equal(t, "DIRECT", result)
+	now = now.Add(time.Second)
+	_, ok = c.get("http://www.test/")
+	assert.False(t, ok)
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	c := newResultCache(time.Minute, 2)
+	c.add("a", "PROXY a:80")
+	c.add("b", "PROXY b:80")
+	_, ok := c.get("a") // "a" is now the most recently used entry
+	assert.True(t, ok)
+	c.add("c", "PROXY c:80")
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	_, ok = c.get("a")
+	assert.True(t, ok)
+	_, ok = c.get("c")
+	assert.True(t, ok)
+	c.flush()
+	_, ok = c.get("a")
+	assert.False(t, ok)
+}
+
+func TestPACRunnerCachesResults(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		lookups := 0
+		pr := PACRunner{engine: engine, cacheTTL: time.Minute, lookupHost: func(host string) ([]string, error) {
+			lookups++
+			return []string{"192.0.2.1"}, nil
+		}}
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			return isResolvable(host) ? "PROXY proxy.test:80" : "DIRECT";
+		}`)
+		require.NoError(t, pr.Update(pacjs))
+		for _, rawurl := range []string{
+			"https://www.test/a", "https://www.test/b", "http://www.test/c", "http://www.test/c",
+		} {
+			u, err := url.Parse(rawurl)
+			require.NoError(t, err)
+			proxy, err := pr.FindProxyForURL(*u)
+			require.NoError(t, err)
+			assert.Equal(t, "PROXY proxy.test:80", proxy)
+		}
+		// The two https:// requests share a cache entry, as do the two http:// requests.
+		assert.Equal(t, 2, lookups)
+		// The cache is flushed when the network changes, and when the script is updated.
+		pr.networkChanged()
+		_, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, 3, lookups)
+		require.NoError(t, pr.Update(pacjs))
+		_, err = pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, 4, lookups)
+	})
+}
+
+func TestPACRunnerCacheKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		pacjs   string
+		lookups int
+	}{
+		{"HostOnly", `function FindProxyForURL(url, host) {
+			return isResolvable(host) ? "PROXY proxy.test:80" : "DIRECT";
+		}`, 1},
+		{"URL", `function FindProxyForURL(url, host) {
+			return isResolvable(host) && !shExpMatch(url, "*/b") ? "PROXY proxy.test:80" : "DIRECT";
+		}`, 3},
+		{"Arguments", `function FindProxyForURL() {
+			return isResolvable(arguments[1]) ? "PROXY proxy.test:80" : "DIRECT";
+		}`, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookups := 0
+			pr := PACRunner{cacheTTL: time.Minute, lookupHost: func(host string) ([]string, error) {
+				lookups++
+				return []string{"192.0.2.1"}, nil
+			}}
+			require.NoError(t, pr.Update([]byte(test.pacjs)))
+			for _, path := range []string{"/a", "/b", "/c", "/a"} {
+				_, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "www.test", Path: path})
+				require.NoError(t, err)
+			}
+			assert.Equal(t, test.lookups, lookups)
+		})
+	}
+}
+
+func TestPACRunnerDoesNotCacheTimeDependentResults(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine pacEngine) {
+		hour := 11
+		pr := PACRunner{engine: engine, cacheTTL: time.Minute, now: func() time.Time {
+			return time.Date(2019, 7, 1, hour, 0, 0, 0, time.UTC)
+		}}
+		pacjs := []byte(`function FindProxyForURL(url, host) {
+			return timeRange(9, 12) ? "PROXY proxy.test:80" : "DIRECT";
+		}`)
+		require.NoError(t, pr.Update(pacjs))
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "PROXY proxy.test:80", proxy)
+		hour = 13
+		proxy, err = pr.FindProxyForURL(url.URL{Scheme: "https", Host: "www.test"})
+		require.NoError(t, err)
+		assert.Equal(t, "DIRECT", proxy)
+	})
+}
@@ -0,0 +1,556 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const setupComment = "Added by alpaca setup (run \"alpaca setup -undo\" to remove)"
+
+// setupEnv is where "alpaca setup" finds the files that it changes.
+type setupEnv struct {
+	home  string // The user's home directory
+	state string // The file recording what was changed, so that it can be undone
+	shell string // The user's shell, used if -shell isn't given
+}
+
+// setupTools are the tools that "alpaca setup" can configure, and the functions that change
+// their config files (relative to the home directory) to use alpaca.
+var setupTools = map[string]struct {
+	path string
+	edit func(old []byte, exists bool, cfg setupConfig) ([]byte, error)
+}{
+	"docker": {filepath.Join(".docker", "config.json"), editDockerConfig},
+	"git":    {".gitconfig", editGitConfig},
+	"maven":  {filepath.Join(".m2", "settings.xml"), editMavenSettings},
+	"npm":    {".npmrc", editNPMRC},
+}
+
+// setupConfig is the proxy configuration that "alpaca setup" writes.
+type setupConfig struct {
+	host    string   // The host that clients use to connect to alpaca
+	port    string   // The port that alpaca is listening on
+	noProxy []string // Hosts and domains that shouldn't be sent via alpaca
+	// The host that Docker containers use to connect to alpaca
+	containerHost string
+}
+
+func (c setupConfig) proxy() string {
+	return "http://" + net.JoinHostPort(c.host, c.port)
+}
+
+// setupCommand implements the "alpaca setup" subcommand, which configures the user's shell
+// (and, optionally, other tools) to use a running instance of Alpaca as their proxy. It returns
+// the exit status for the process.
+func setupCommand(args []string, stdout, stderr io.Writer) int {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error finding home directory: %v\n", err)
+		return 1
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error finding config directory: %v\n", err)
+		return 1
+	}
+	env := setupEnv{
+		home:  home,
+		state: filepath.Join(dir, "alpaca", "setup.json"),
+		shell: defaultShell(),
+	}
+	return runSetup(env, args, stdout, stderr)
+}
+
+func runSetup(env setupEnv, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("alpaca setup", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: alpaca setup [flags]")
+		fs.PrintDefaults()
+	}
+	host := fs.String("l", "localhost", "address that alpaca is listening on")
+	port := fs.Int("p", 3128, "port number that alpaca is listening on")
+	shell := fs.String("shell", env.shell, "shell to print (or write) exports for: bash, zsh, fish or powershell")
+	noProxy := fs.String("no-proxy", "localhost,127.0.0.1,::1", "comma-separated hosts and domains that shouldn't be sent via alpaca")
+	write := fs.Bool("write", false, "add the exports to the shell's startup file, rather than printing them")
+	tools := fs.String("tools", "", "comma-separated tools to configure: docker, git, maven, npm")
+	containerHost := fs.String("container-host", "host.docker.internal", "address that docker containers use to connect to alpaca")
+	undo := fs.Bool("undo", false, "undo the changes made by alpaca setup")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	} else if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	state, err := loadSetupState(env.state)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading %s: %v\n", env.state, err)
+		return 1
+	}
+	if *undo {
+		status := state.undo(stdout, stderr)
+		if err := state.save(env.state); err != nil {
+			fmt.Fprintf(stderr, "Error writing %s: %v\n", env.state, err)
+			return 1
+		}
+		return status
+	}
+
+	cfg := setupConfig{host: *host, port: strconv.Itoa(*port), containerHost: *containerHost}
+	if ip := net.ParseIP(cfg.host); cfg.host == "" || (ip != nil && ip.IsUnspecified()) {
+		cfg.host = "localhost"
+	}
+	for _, host := range strings.Split(*noProxy, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.noProxy = append(cfg.noProxy, host)
+		}
+	}
+	if *shell == "pwsh" {
+		*shell = "powershell"
+	}
+	exports, err := shellExports(*shell, cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid -shell: %v\n", err)
+		return 2
+	}
+	var names []string
+	for _, name := range strings.Split(*tools, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		} else if _, ok := setupTools[name]; !ok {
+			fmt.Fprintf(stderr, "Unknown tool %q (must be one of docker, git, maven, npm)\n", name)
+			return 2
+		}
+		names = append(names, name)
+	}
+
+	status := 0
+	edit := func(path string, change func(old []byte, exists bool) ([]byte, error)) {
+		if err := state.edit(path, change); err != nil {
+			fmt.Fprintf(stderr, "Error writing %s: %v\n", path, err)
+			status = 1
+			return
+		}
+		fmt.Fprintf(stdout, "# Wrote %s\n", path)
+	}
+	if *write {
+		edit(shellStartupFile(*shell, env.home), func(old []byte, exists bool) ([]byte, error) {
+			return appendBlock(old, "# "+setupComment+"\n"+exports), nil
+		})
+	} else {
+		fmt.Fprint(stdout, exports)
+	}
+	for _, name := range names {
+		tool := setupTools[name]
+		edit(filepath.Join(env.home, tool.path), func(old []byte, exists bool) ([]byte, error) {
+			return tool.edit(old, exists, cfg)
+		})
+	}
+	if err := state.save(env.state); err != nil {
+		fmt.Fprintf(stderr, "Error writing %s: %v\n", env.state, err)
+		return 1
+	}
+	return status
+}
+
+// defaultShell guesses which shell the user is running.
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	switch shell := filepath.Base(os.Getenv("SHELL")); shell {
+	case "zsh", "fish":
+		return shell
+	case "pwsh":
+		return "powershell"
+	}
+	return "bash"
+}
+
+// shellStartupFile returns the file that a shell runs when it starts.
+func shellStartupFile(shell, home string) string {
+	switch shell {
+	case "zsh":
+		return filepath.Join(home, ".zshrc")
+	case "fish":
+		return filepath.Join(home, ".config", "fish", "conf.d", "alpaca.fish")
+	case "powershell":
+		if runtime.GOOS == "windows" {
+			return filepath.Join(home, "Documents", "PowerShell", "Microsoft.PowerShell_profile.ps1")
+		}
+		return filepath.Join(home, ".config", "powershell", "Microsoft.PowerShell_profile.ps1")
+	}
+	return filepath.Join(home, ".bashrc")
+}
+
+// shellExports returns the commands that set the proxy environment variables in a shell.
+func shellExports(shell string, cfg setupConfig) (string, error) {
+	var format func(name, value string) string
+	switch shell {
+	case "bash", "zsh":
+		format = func(name, value string) string {
+			return "export " + name + "='" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+		}
+	case "fish":
+		format = func(name, value string) string {
+			value = strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value)
+			return "set -gx " + name + " '" + value + "'"
+		}
+	case "powershell":
+		format = func(name, value string) string {
+			return "$env:" + name + " = '" + strings.ReplaceAll(value, "'", "''") + "'"
+		}
+	default:
+		return "", fmt.Errorf("unknown shell %q (must be one of bash, zsh, fish, powershell)", shell)
+	}
+	var b strings.Builder
+	for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		fmt.Fprintln(&b, format(name, cfg.proxy()))
+	}
+	if len(cfg.noProxy) > 0 {
+		noProxy := strings.Join(cfg.noProxy, ",")
+		fmt.Fprintln(&b, format("no_proxy", noProxy))
+		fmt.Fprintln(&b, format("NO_PROXY", noProxy))
+	}
+	return b.String(), nil
+}
+
+// appendBlock adds lines to the end of a file, separated from what's already there.
+func appendBlock(old []byte, block string) []byte {
+	var b bytes.Buffer
+	b.Write(old)
+	if len(old) > 0 && !bytes.HasSuffix(old, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	if len(old) > 0 {
+		b.WriteByte('\n')
+	}
+	b.WriteString(block)
+	return b.Bytes()
+}
+
+// editNPMRC replaces any proxy settings in an .npmrc file.
+func editNPMRC(old []byte, exists bool, cfg setupConfig) ([]byte, error) {
+	var b bytes.Buffer
+	for _, line := range strings.SplitAfter(string(old), "\n") {
+		key, _, _ := strings.Cut(line, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "proxy", "https-proxy", "noproxy":
+			continue
+		}
+		b.WriteString(line)
+	}
+	block := "; " + setupComment + "\n" +
+		"proxy=" + cfg.proxy() + "\n" +
+		"https-proxy=" + cfg.proxy() + "\n"
+	if len(cfg.noProxy) > 0 {
+		block += "noproxy=" + strings.Join(cfg.noProxy, ",") + "\n"
+	}
+	return appendBlock(b.Bytes(), block), nil
+}
+
+// editGitConfig sets http.proxy in a .gitconfig file, replacing any existing value. Git uses
+// no_proxy from the environment, so there's nothing else to set.
+func editGitConfig(old []byte, exists bool, cfg setupConfig) ([]byte, error) {
+	var b bytes.Buffer
+	section := ""
+	done := false
+	for _, line := range strings.SplitAfter(string(old), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			name, _, _ := strings.Cut(trimmed[1:], "]")
+			section = strings.ToLower(strings.TrimSpace(name))
+			b.WriteString(line)
+			if section == "http" && !done {
+				if !strings.HasSuffix(line, "\n") {
+					b.WriteByte('\n')
+				}
+				b.WriteString("\t# " + setupComment + "\n\tproxy = " + cfg.proxy() + "\n")
+				done = true
+			}
+			continue
+		} else if section == "http" {
+			key, _, _ := strings.Cut(trimmed, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "proxy") {
+				continue
+			}
+		}
+		b.WriteString(line)
+	}
+	if done {
+		return b.Bytes(), nil
+	}
+	block := "# " + setupComment + "\n[http]\n\tproxy = " + cfg.proxy() + "\n"
+	return appendBlock(b.Bytes(), block), nil
+}
+
+// editMavenSettings adds proxies to the start of the list in a Maven settings.xml file, so that
+// Maven uses them rather than any that were already there.
+func editMavenSettings(old []byte, exists bool, cfg setupConfig) ([]byte, error) {
+	var nonProxyHosts []string
+	for _, host := range cfg.noProxy {
+		if strings.HasPrefix(host, ".") {
+			host = "*" + host
+		}
+		nonProxyHosts = append(nonProxyHosts, host)
+	}
+	var proxies strings.Builder
+	fmt.Fprintf(&proxies, "\n    <!-- %s -->", setupComment)
+	for _, protocol := range []string{"http", "https"} {
+		fmt.Fprintf(&proxies, `
+    <proxy>
+      <id>alpaca-%s</id>
+      <active>true</active>
+      <protocol>%s</protocol>
+      <host>%s</host>
+      <port>%s</port>`, protocol, protocol, xmlText(cfg.host), cfg.port)
+		if len(nonProxyHosts) > 0 {
+			fmt.Fprintf(&proxies, "\n      <nonProxyHosts>%s</nonProxyHosts>",
+				xmlText(strings.Join(nonProxyHosts, "|")))
+		}
+		proxies.WriteString("\n    </proxy>")
+	}
+	if !exists || len(bytes.TrimSpace(old)) == 0 {
+		return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<settings xmlns="http://maven.apache.org/SETTINGS/1.0.0"
+          xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
+          xsi:schemaLocation="http://maven.apache.org/SETTINGS/1.0.0 https://maven.apache.org/xsd/settings-1.0.0.xsd">
+  <proxies>` + proxies.String() + `
+  </proxies>
+</settings>
+`), nil
+	}
+	s := string(old)
+	if i := strings.Index(s, "<proxies>"); i >= 0 {
+		i += len("<proxies>")
+		return []byte(s[:i] + proxies.String() + s[i:]), nil
+	} else if i := strings.Index(s, "<proxies/>"); i >= 0 {
+		return []byte(s[:i] + "<proxies>" + proxies.String() + "\n  </proxies>" + s[i+len("<proxies/>"):]), nil
+	} else if i := strings.LastIndex(s, "</settings>"); i >= 0 {
+		return []byte(s[:i] + "  <proxies>" + proxies.String() + "\n  </proxies>\n" + s[i:]), nil
+	}
+	return nil, errors.New("it doesn't look like a Maven settings file (no </settings> tag)")
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// editDockerConfig sets the default proxies that the Docker CLI gives to containers. Docker
+// containers can't use alpaca's loopback address, so they use the container host instead.
+func editDockerConfig(old []byte, exists bool, cfg setupConfig) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	if exists && len(bytes.TrimSpace(old)) > 0 {
+		if err := json.Unmarshal(old, &config); err != nil {
+			return nil, err
+		}
+	}
+	proxies := map[string]json.RawMessage{}
+	if raw, ok := config["proxies"]; ok {
+		if err := json.Unmarshal(raw, &proxies); err != nil {
+			return nil, fmt.Errorf("invalid proxies: %w", err)
+		}
+	}
+	proxy := "http://" + net.JoinHostPort(cfg.containerHost, cfg.port)
+	def := map[string]string{"httpProxy": proxy, "httpsProxy": proxy}
+	if len(cfg.noProxy) > 0 {
+		def["noProxy"] = strings.Join(cfg.noProxy, ",")
+	}
+	var err error
+	if proxies["default"], err = json.Marshal(def); err != nil {
+		return nil, err
+	}
+	if config["proxies"], err = json.Marshal(proxies); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(config); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// setupState records the files that "alpaca setup" has changed, so that it can put them back
+// the way they were.
+type setupState struct {
+	Files []*setupFile `json:"files,omitempty"`
+	// Directories that were created to hold new files, in the order they were created
+	Dirs []string `json:"dirs,omitempty"`
+}
+
+type setupFile struct {
+	Path     string  `json:"path"`
+	Original *string `json:"original"` // nil if the file didn't exist
+	Written  string  `json:"written"`
+}
+
+func loadSetupState(path string) (*setupState, error) {
+	state := &setupState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return state, json.Unmarshal(data, state)
+}
+
+func (s *setupState) save(path string) error {
+	if len(s.Files) == 0 && len(s.Dirs) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// edit changes a file, and records what it was before. If the file has already been changed,
+// the change is made to the original file instead (so running setup again doesn't add the same
+// lines twice), unless the file has been changed since.
+func (s *setupState) edit(path string, change func(old []byte, exists bool) ([]byte, error)) error {
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	old, exists := current, err == nil
+	var file *setupFile
+	for _, f := range s.Files {
+		if f.Path == path {
+			file = f
+		}
+	}
+	if file != nil {
+		if !exists || string(current) != file.Written {
+			return errors.New("it has changed since alpaca setup wrote it (use -undo first)")
+		}
+		old, exists = nil, file.Original != nil
+		if exists {
+			old = []byte(*file.Original)
+		}
+	}
+	data, err := change(old, exists)
+	if err != nil {
+		return err
+	}
+	if err := s.mkdirs(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	if file == nil {
+		file = &setupFile{Path: path}
+		if exists {
+			original := string(current)
+			file.Original = &original
+		}
+		s.Files = append(s.Files, file)
+	}
+	file.Written = string(data)
+	return nil
+}
+
+// mkdirs creates a directory and any missing parents, and records the ones it creates.
+func (s *setupState) mkdirs(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		} else if filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil {
+			return err
+		}
+		s.Dirs = append(s.Dirs, missing[i])
+	}
+	return nil
+}
+
+// undo puts the files back the way they were, unless they've been changed since they were
+// written (in which case they're left alone). Files that weren't restored, and directories
+// that still exist, stay in the state so that undo can be run again later. It returns the exit
+// status for the process.
+func (s *setupState) undo(stdout, stderr io.Writer) int {
+	status := 0
+	var files []*setupFile
+	for i := len(s.Files) - 1; i >= 0; i-- {
+		f := s.Files[i]
+		current, err := os.ReadFile(f.Path)
+		if err != nil || string(current) != f.Written {
+			fmt.Fprintf(stderr, "Not restoring %s: it has changed since alpaca setup wrote it\n", f.Path)
+			files = append(files, f)
+			status = 1
+			continue
+		}
+		if f.Original == nil {
+			err = os.Remove(f.Path)
+		} else {
+			err = os.WriteFile(f.Path, []byte(*f.Original), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Error restoring %s: %v\n", f.Path, err)
+			files = append(files, f)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "Restored %s\n", f.Path)
+	}
+	var dirs []string
+	for i := len(s.Dirs) - 1; i >= 0; i-- {
+		// This fails (which is fine) if something else has been put in the directory.
+		if err := os.Remove(s.Dirs[i]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			dirs = append(dirs, s.Dirs[i])
+		}
+	}
+	// Both lists were built backwards, so put them back in their original order.
+	slices.Reverse(files)
+	slices.Reverse(dirs)
+	s.Files, s.Dirs = files, dirs
+	return status
+}
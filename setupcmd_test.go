@@ -0,0 +1,245 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSetupConfig = setupConfig{
+	host:          "localhost",
+	port:          "3128",
+	noProxy:       []string{"localhost", ".corp.test"},
+	containerHost: "host.docker.internal",
+}
+
+func TestShellExports(t *testing.T) {
+	tests := []struct {
+		shell    string
+		proxy    string
+		noProxy  string
+		expected bool
+	}{
+		{"bash", "export http_proxy='http://localhost:3128'",
+			"export NO_PROXY='localhost,.corp.test'", true},
+		{"zsh", "export HTTPS_PROXY='http://localhost:3128'",
+			"export no_proxy='localhost,.corp.test'", true},
+		{"fish", "set -gx http_proxy 'http://localhost:3128'",
+			"set -gx NO_PROXY 'localhost,.corp.test'", true},
+		{"powershell", "$env:https_proxy = 'http://localhost:3128'",
+			"$env:no_proxy = 'localhost,.corp.test'", true},
+		{"csh", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.shell, func(t *testing.T) {
+			exports, err := shellExports(test.shell, testSetupConfig)
+			if !test.expected {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, exports, test.proxy+"\n")
+			assert.Contains(t, exports, test.noProxy+"\n")
+		})
+	}
+}
+
+func TestEditNPMRC(t *testing.T) {
+	old := "registry=https://registry.test/\nproxy=http://old.test:80\n//registry.test/:_authToken=secret\n"
+	data, err := editNPMRC([]byte(old), true, testSetupConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "registry=https://registry.test/\n//registry.test/:_authToken=secret\n\n"+
+		"; "+setupComment+"\n"+
+		"proxy=http://localhost:3128\n"+
+		"https-proxy=http://localhost:3128\n"+
+		"noproxy=localhost,.corp.test\n", string(data))
+}
+
+func TestEditGitConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      string
+		expected string
+	}{
+		{"Empty", "", "# " + setupComment + "\n[http]\n\tproxy = http://localhost:3128\n"},
+		{"NoHTTPSection", "[user]\n\tname = Test\n",
+			"[user]\n\tname = Test\n\n# " + setupComment + "\n[http]\n\tproxy = http://localhost:3128\n"},
+		{"ReplaceProxy", "[http]\n\tproxy = http://old.test:80\n\tsslVerify = true\n[user]\n\tname = Test\n",
+			"[http]\n\t# " + setupComment + "\n\tproxy = http://localhost:3128\n\tsslVerify = true\n" +
+				"[user]\n\tname = Test\n"},
+		{"URLSection", "[http \"https://git.test\"]\n\tproxy = http://other.test:80\n",
+			"[http \"https://git.test\"]\n\tproxy = http://other.test:80\n\n# " + setupComment +
+				"\n[http]\n\tproxy = http://localhost:3128\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := editGitConfig([]byte(test.old), test.old != "", testSetupConfig)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(data))
+		})
+	}
+}
+
+func TestEditMavenSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+	}{
+		{"Missing", ""},
+		{"NoProxies", "<settings>\n  <offline>false</offline>\n</settings>\n"},
+		{"EmptyProxies", "<settings>\n  <proxies/>\n</settings>\n"},
+		{"Proxies", "<settings>\n  <proxies>\n    <proxy><id>old</id></proxy>\n  </proxies>\n</settings>\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := editMavenSettings([]byte(test.old), test.old != "", testSetupConfig)
+			require.NoError(t, err)
+			var settings struct {
+				Proxies []struct {
+					ID            string `xml:"id"`
+					Protocol      string `xml:"protocol"`
+					Host          string `xml:"host"`
+					Port          string `xml:"port"`
+					NonProxyHosts string `xml:"nonProxyHosts"`
+				} `xml:"proxies>proxy"`
+			}
+			require.NoError(t, xml.Unmarshal(data, &settings), string(data))
+			require.GreaterOrEqual(t, len(settings.Proxies), 2)
+			// Our proxies come first, so that Maven uses them.
+			assert.Equal(t, "alpaca-http", settings.Proxies[0].ID)
+			assert.Equal(t, "https", settings.Proxies[1].Protocol)
+			assert.Equal(t, "localhost", settings.Proxies[1].Host)
+			assert.Equal(t, "3128", settings.Proxies[1].Port)
+			assert.Equal(t, "localhost|*.corp.test", settings.Proxies[1].NonProxyHosts)
+		})
+	}
+	_, err := editMavenSettings([]byte("<project/>"), true, testSetupConfig)
+	assert.Error(t, err)
+}
+
+func TestEditDockerConfig(t *testing.T) {
+	old := `{"auths": {"registry.test": {"auth": "c2VjcmV0"}}, "proxies": {"tcp://remote.test:2376": {"httpProxy": "http://other.test:80"}}}`
+	data, err := editDockerConfig([]byte(old), true, testSetupConfig)
+	require.NoError(t, err)
+	var config struct {
+		Auths   map[string]map[string]string `json:"auths"`
+		Proxies map[string]map[string]string `json:"proxies"`
+	}
+	require.NoError(t, json.Unmarshal(data, &config))
+	assert.Equal(t, "c2VjcmV0", config.Auths["registry.test"]["auth"])
+	assert.Equal(t, "http://other.test:80", config.Proxies["tcp://remote.test:2376"]["httpProxy"])
+	assert.Equal(t, map[string]string{
+		"httpProxy":  "http://host.docker.internal:3128",
+		"httpsProxy": "http://host.docker.internal:3128",
+		"noProxy":    "localhost,.corp.test",
+	}, config.Proxies["default"])
+	_, err = editDockerConfig([]byte("not json"), true, testSetupConfig)
+	assert.Error(t, err)
+}
+
+func TestSetupAndUndo(t *testing.T) {
+	home := t.TempDir()
+	env := setupEnv{home: home, state: filepath.Join(t.TempDir(), "setup.json"), shell: "bash"}
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		status := runSetup(env, args, &stdout, &stderr)
+		return status, stdout.String(), stderr.String()
+	}
+	bashrc := "alias ll='ls -l'\n"
+	gitconfig := "[http]\n\tproxy = http://old.test:80\n"
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".bashrc"), []byte(bashrc), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitconfig), 0644))
+
+	// Without -write, the exports are printed.
+	status, stdout, stderr := run("-p", "3129")
+	require.Equal(t, 0, status, stderr)
+	assert.Contains(t, stdout, "export http_proxy='http://localhost:3129'\n")
+	_, err := os.Stat(env.state)
+	assert.True(t, os.IsNotExist(err))
+
+	args := []string{"-p", "3129", "-write", "-tools", "docker,git,maven,npm"}
+	status, _, stderr = run(args...)
+	require.Equal(t, 0, status, stderr)
+	written := map[string]string{}
+	for _, path := range []string{".bashrc", ".gitconfig", ".npmrc", ".m2/settings.xml", ".docker/config.json"} {
+		data, err := os.ReadFile(filepath.Join(home, path))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "3129", path)
+		written[path] = string(data)
+	}
+	assert.Contains(t, written[".bashrc"], bashrc)
+
+	// Running it again doesn't add another copy of the exports.
+	status, _, stderr = run(args...)
+	require.Equal(t, 0, status, stderr)
+	data, err := os.ReadFile(filepath.Join(home, ".bashrc"))
+	require.NoError(t, err)
+	assert.Equal(t, written[".bashrc"], string(data))
+
+	// Files that have been changed since they were written are left alone.
+	changed := written[".npmrc"] + "save-exact=true\n"
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".npmrc"), []byte(changed), 0644))
+	status, stdout, stderr = run("-undo")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "Not restoring "+filepath.Join(home, ".npmrc"))
+	assert.Contains(t, stdout, "Restored "+filepath.Join(home, ".bashrc"))
+
+	data, err = os.ReadFile(filepath.Join(home, ".bashrc"))
+	require.NoError(t, err)
+	assert.Equal(t, bashrc, string(data))
+	data, err = os.ReadFile(filepath.Join(home, ".gitconfig"))
+	require.NoError(t, err)
+	assert.Equal(t, gitconfig, string(data))
+	data, err = os.ReadFile(filepath.Join(home, ".npmrc"))
+	require.NoError(t, err)
+	assert.Equal(t, changed, string(data))
+	for _, path := range []string{filepath.Join(home, ".m2"), filepath.Join(home, ".docker")} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+
+	// The file that wasn't restored is still recorded, so undo can be run again.
+	state, err := loadSetupState(env.state)
+	require.NoError(t, err)
+	require.Len(t, state.Files, 1)
+	assert.Equal(t, filepath.Join(home, ".npmrc"), state.Files[0].Path)
+	assert.Empty(t, state.Dirs)
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".npmrc"), []byte(written[".npmrc"]), 0644))
+	status, stdout, stderr = run("-undo")
+	require.Equal(t, 0, status, stderr)
+	assert.Contains(t, stdout, "Restored "+filepath.Join(home, ".npmrc"))
+	for _, path := range []string{filepath.Join(home, ".npmrc"), env.state} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestSetupInvalidFlags(t *testing.T) {
+	env := setupEnv{home: t.TempDir(), state: filepath.Join(t.TempDir(), "setup.json"), shell: "bash"}
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, runSetup(env, []string{"-shell", "csh"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), `unknown shell "csh"`)
+	stderr.Reset()
+	assert.Equal(t, 2, runSetup(env, []string{"-tools", "gradle"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), `Unknown tool "gradle"`)
+}
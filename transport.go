@@ -16,7 +16,7 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
+	"context"
 	"errors"
 	"net"
 	"net/http"
@@ -29,6 +29,7 @@ import (
 type transport struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	tls    *proxyTLS // Used to connect to HTTPS proxies
 }
 
 func (t *transport) dial(proxy *url.URL) error {
@@ -38,7 +39,7 @@ func (t *transport) dial(proxy *url.URL) error {
 	var conn net.Conn
 	var err error
 	if proxy.Scheme == "https" {
-		conn, err = tls.Dial("tcp", proxy.Host, tlsClientConfig)
+		conn, err = t.tls.dial(context.Background(), proxy.Host)
 	} else {
 		conn, err = net.Dial("tcp", proxy.Host)
 	}